@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type NotifierConfig struct {
+	Type    string `json:"type"`
+	URL     string `json:"url"`
+	Channel string `json:"channel"`
+}
+
+type AlertsConfig struct {
+	IntervalMs       int64            `json:"interval_ms"`
+	NoPublishSeconds int64            `json:"no_publish_seconds"`
+	NodeDownFailures int              `json:"node_down_failures"`
+	CooldownSeconds  int64            `json:"cooldown_seconds"`
+	RuleCooldowns    map[string]int64 `json:"rule_cooldowns"`
+	Notifiers        []NotifierConfig `json:"notifiers"`
+}
+
+func (c *AlertsConfig) validate() error {
+	if err := checkRange("alerts.interval_ms", c.IntervalMs, maxConfigMs); err != nil {
+		return err
+	}
+	if err := checkRange("alerts.no_publish_seconds", c.NoPublishSeconds, maxConfigSeconds); err != nil {
+		return err
+	}
+	if err := checkRange("alerts.cooldown_seconds", c.CooldownSeconds, maxConfigSeconds); err != nil {
+		return err
+	}
+	for rule, seconds := range c.RuleCooldowns {
+		if err := checkRange("alerts.rule_cooldowns."+rule, seconds, maxConfigSeconds); err != nil {
+			return err
+		}
+	}
+	if c.NodeDownFailures < 0 {
+		return errors.New("alerts.node_down_failures must not be negative")
+	}
+	return nil
+}
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+type alertEvent struct {
+	Rule    string `json:"rule"`
+	State   string `json:"state"`
+	Message string `json:"message"`
+	At      int64  `json:"at"`
+}
+
+type alertNotifier interface {
+	Notify(ctx context.Context, event *alertEvent) error
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, event *alertEvent) error {
+	if event.State == alertFiring {
+		log.Printf("ALERT %s: %s", event.Rule, event.Message)
+	} else {
+		log.Printf("RESOLVED %s: %s", event.Rule, event.Message)
+	}
+	return nil
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, event *alertEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return errors.Errorf("webhook answered %s", response.Status)
+	}
+	return nil
+}
+
+type redisNotifier struct {
+	rdb     *redis.Client
+	channel string
+}
+
+func (n *redisNotifier) Notify(ctx context.Context, event *alertEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return n.rdb.Publish(ctx, n.channel, payload).Err()
+}
+
+func newAlertNotifiers(configs []NotifierConfig, rdb *redis.Client) ([]alertNotifier, error) {
+	if len(configs) == 0 {
+		return []alertNotifier{logNotifier{}}, nil
+	}
+	notifiers := make([]alertNotifier, 0, len(configs))
+	for _, config := range configs {
+		switch config.Type {
+		case "log":
+			notifiers = append(notifiers, logNotifier{})
+		case "webhook":
+			notifiers = append(notifiers, &webhookNotifier{url: config.URL, client: &http.Client{Timeout: 5 * time.Second}})
+		case "redis":
+			notifiers = append(notifiers, &redisNotifier{rdb: rdb, channel: config.Channel})
+		default:
+			return nil, errors.Errorf("unknown alert notifier type %q", config.Type)
+		}
+	}
+	return notifiers, nil
+}
+
+// alertRule reports whether its condition currently holds and why.
+type alertRule struct {
+	name  string
+	check func(ctx context.Context, now time.Time) (bool, string)
+}
+
+type ruleState struct {
+	firing    bool
+	firedAt   time.Time
+	lastFired time.Time
+}
+
+// AlertEngine evaluates its rules periodically and notifies on transitions
+// only, so a condition that keeps holding is reported once. After a rule
+// resolves it cannot fire again until its cooldown has passed.
+type AlertEngine struct {
+	clock     clock
+	config    AlertsConfig
+	rules     []*alertRule
+	notifiers []alertNotifier
+
+	mutex  sync.Mutex
+	states map[string]*ruleState
+}
+
+func NewAlertEngine(config AlertsConfig, notifiers []alertNotifier, clk clock) *AlertEngine {
+	if config.IntervalMs == 0 {
+		config.IntervalMs = 1000
+	}
+	if config.CooldownSeconds == 0 {
+		config.CooldownSeconds = 300
+	}
+	return &AlertEngine{
+		clock:     clk,
+		config:    config,
+		notifiers: notifiers,
+		states:    make(map[string]*ruleState),
+	}
+}
+
+func (e *AlertEngine) AddRule(name string, check func(ctx context.Context, now time.Time) (bool, string)) {
+	e.rules = append(e.rules, &alertRule{name: name, check: check})
+	e.states[name] = &ruleState{}
+}
+
+func (e *AlertEngine) cooldown(rule string) time.Duration {
+	if seconds, ok := e.config.RuleCooldowns[rule]; ok {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(e.config.CooldownSeconds) * time.Second
+}
+
+func (e *AlertEngine) Run(ctx context.Context) {
+	ticks, stop := e.clock.Tick(time.Duration(e.config.IntervalMs) * time.Millisecond)
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticks:
+			e.evaluate(ctx, now)
+		}
+	}
+}
+
+func (e *AlertEngine) evaluate(ctx context.Context, now time.Time) {
+	var events []*alertEvent
+	for _, rule := range e.rules {
+		firing, message := rule.check(ctx, now)
+
+		e.mutex.Lock()
+		state := e.states[rule.name]
+		switch {
+		case firing && !state.firing:
+			if state.lastFired.IsZero() || now.Sub(state.lastFired) >= e.cooldown(rule.name) {
+				state.firing, state.firedAt, state.lastFired = true, now, now
+				events = append(events, &alertEvent{Rule: rule.name, State: alertFiring, Message: message, At: now.UnixMilli()})
+			}
+		case !firing && state.firing:
+			state.firing = false
+			message = fmt.Sprintf("resolved after %v", now.Sub(state.firedAt).Round(time.Second))
+			events = append(events, &alertEvent{Rule: rule.name, State: alertResolved, Message: message, At: now.UnixMilli()})
+		}
+		e.mutex.Unlock()
+	}
+	for _, event := range events {
+		e.notify(ctx, event)
+	}
+}
+
+func (e *AlertEngine) notify(ctx context.Context, event *alertEvent) {
+	for _, notifier := range e.notifiers {
+		if err := notifier.Notify(ctx, event); err != nil {
+			log.Printf("error sending %s alert %s: %v", event.State, event.Rule, err)
+		}
+	}
+}
+
+func (e *AlertEngine) statusSection() interface{} {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	firing := []string{}
+	for _, rule := range e.rules {
+		if e.states[rule.name].firing {
+			firing = append(firing, rule.name)
+		}
+	}
+	return map[string]interface{}{"firing": firing}
+}
+
+// nodesDownRule fires once every node failed the given number of fetch
+// rounds in a row. Fetches that fail after a node answered, e.g. on publish,
+// don't count.
+func nodesDownRule(health *fetcherHealth, failures int) func(ctx context.Context, now time.Time) (bool, string) {
+	return func(ctx context.Context, now time.Time) (bool, string) {
+		snapshot := health.Snapshot()
+		return snapshot.NodeFailures >= failures,
+			fmt.Sprintf("every node failed %d consecutive fetches, last error: %s", snapshot.NodeFailures, snapshot.LastNodeError)
+	}
+}
+
+// zeroSubscribersRule fires when the last template reached fewer consumers
+// than expected, or none at all.
+func zeroSubscribersRule(publisher *TemplatePublisher) func(ctx context.Context, now time.Time) (bool, string) {
+	return func(ctx context.Context, now time.Time) (bool, string) {
+		low, subscribers := publisher.SubscribersLow()
+		return low, fmt.Sprintf("%s has %d subscribers (expected at least %d)",
+			publisher.channel, subscribers, publisher.minSubscribers)
+	}
+}
+
+// addFetcherAlertRules installs the built-in rules. expectedScript is the
+// script public key of the treasury address the coinbase must pay to.
+func addFetcherAlertRules(engine *AlertEngine, config AlertsConfig, rdb *redis.Client, publisher *TemplatePublisher,
+	health *fetcherHealth, cache *templateCache, expectedScript []byte) {
+
+	noPublish := time.Duration(config.NoPublishSeconds) * time.Second
+	if noPublish == 0 {
+		noPublish = 30 * time.Second
+	}
+	nodeDownFailures := config.NodeDownFailures
+	if nodeDownFailures == 0 {
+		nodeDownFailures = 3
+	}
+
+	engine.AddRule("no_publish", func(ctx context.Context, now time.Time) (bool, string) {
+		snapshot := health.Snapshot()
+		last := health.startedAt
+		if snapshot.LastSuccess != 0 {
+			last = time.UnixMilli(snapshot.LastSuccess)
+		}
+		return now.Sub(last) > noPublish, fmt.Sprintf("nothing published for %v", now.Sub(last).Round(time.Second))
+	})
+	engine.AddRule("node_unsynced", func(ctx context.Context, now time.Time) (bool, string) {
+		snapshot := health.Snapshot()
+		return snapshot.LastSuccess != 0 && !snapshot.Synced, "node reports it is not synced"
+	})
+	engine.AddRule("nodes_down", nodesDownRule(health, nodeDownFailures))
+	engine.AddRule("redis_down", func(ctx context.Context, now time.Time) (bool, string) {
+		err := rdb.Ping(ctx).Err()
+		return err != nil, fmt.Sprintf("redis ping failed: %v", err)
+	})
+	engine.AddRule("zero_subscribers", zeroSubscribersRule(publisher))
+	engine.AddRule("coinbase_address_mismatch", func(ctx context.Context, now time.Time) (bool, string) {
+		template, restored := cache.Get()
+		if template == nil || restored {
+			return false, ""
+		}
+		script, err := coinbaseScript(template)
+		if err != nil {
+			return true, err.Error()
+		}
+		return !bytes.Equal(script, expectedScript),
+			fmt.Sprintf("coinbase pays to script %x instead of the treasury address", script)
+	})
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// archiveDriver is the database/sql driver used for the archive.
+const archiveDriver = "sqlite3"
+
+type ArchiveConfig struct {
+	Path           string `json:"path"`
+	RetentionHours int    `json:"retention_hours"`
+}
+
+// archiveSchemaVersion is the version of archiveSchema, recorded in the
+// database's user_version.
+const archiveSchemaVersion = 4
+
+const archiveSchema = `
+CREATE TABLE templates (
+	fingerprint        TEXT    NOT NULL,
+	sequence           INTEGER NOT NULL,
+	recorded_at        INTEGER NOT NULL,
+	fetched_at         INTEGER NOT NULL,
+	node               TEXT    NOT NULL,
+	daa_score          INTEGER NOT NULL,
+	blue_score         INTEGER NOT NULL,
+	bits               INTEGER NOT NULL,
+	timestamp          INTEGER NOT NULL,
+	tx_count           INTEGER NOT NULL,
+	coinbase_value     INTEGER NOT NULL,
+	merged_fees        INTEGER NOT NULL,
+	fees               INTEGER NOT NULL,
+	fetch_latency_ms   REAL    NOT NULL,
+	publish_latency_ms REAL    NOT NULL
+);
+CREATE INDEX templates_recorded_at ON templates (recorded_at);
+CREATE INDEX templates_node ON templates (node, recorded_at);
+`
+
+// archiveMigrations[i] upgrades the schema from version i+1 to i+2.
+var archiveMigrations = []string{
+	// Version 1 stored the fees of the merged blocks as fees
+	`ALTER TABLE templates RENAME COLUMN fees TO merged_fees`,
+	`ALTER TABLE templates ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE templates ADD COLUMN fetched_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE templates ADD COLUMN timestamp INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE templates ADD COLUMN coinbase_value INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE templates ADD COLUMN fees INTEGER NOT NULL DEFAULT 0`,
+}
+
+// TemplateArchive records template metadata to an embedded SQLite database.
+// Writes happen on a background goroutine so a slow disk never delays the
+// fetch loop; records are dropped when the queue is full.
+type TemplateArchive struct {
+	clock     clock
+	db        *sql.DB
+	retention time.Duration
+	records   chan *historyRecord
+}
+
+func openArchiveDB(path string) (*sql.DB, error) {
+	db, err := sql.Open(archiveDriver, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening template archive")
+	}
+	if err := migrateArchive(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openArchiveReadOnly opens the archive for the query and export commands,
+// which must not change it. The fetcher migrates the schema when it starts.
+func openArchiveReadOnly(path string) (*sql.DB, error) {
+	db, err := sql.Open(archiveDriver, fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening template archive")
+	}
+	version, err := archiveVersion(db)
+	if err == nil && version != archiveSchemaVersion {
+		err = errors.Errorf("template archive schema version is %d, expected %d, start the fetcher to migrate it",
+			version, archiveSchemaVersion)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// archiveVersion returns the schema version of the archive, 0 for an empty
+// database. Archives created before the version was recorded are told apart
+// by their columns.
+func archiveVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "failed reading template archive version")
+	}
+	if version != 0 {
+		return version, nil
+	}
+
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('templates')`)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed reading template archive schema")
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	switch {
+	case len(columns) == 0:
+		return 0, nil
+	case columns["sequence"]:
+		return 3, nil
+	case columns["merged_fees"]:
+		return 2, nil
+	default:
+		return 1, nil
+	}
+}
+
+// migrateArchive creates the schema in an empty database and upgrades an
+// archive written by an older version.
+func migrateArchive(db *sql.DB) error {
+	version, err := archiveVersion(db)
+	if err != nil {
+		return err
+	}
+	if version == archiveSchemaVersion {
+		return nil
+	}
+	if version > archiveSchemaVersion {
+		return errors.Errorf("template archive schema version %d is newer than the supported version %d",
+			version, archiveSchemaVersion)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed migrating template archive")
+	}
+	defer tx.Rollback()
+	statements := []string{archiveSchema}
+	if version != 0 {
+		statements = archiveMigrations[version-1:]
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return errors.Wrapf(err, "failed migrating template archive from version %d", version)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, archiveSchemaVersion)); err != nil {
+		return errors.Wrap(err, "failed migrating template archive")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "failed migrating template archive")
+	}
+	if version != 0 {
+		log.Printf("migrated template archive from schema version %d to %d", version, archiveSchemaVersion)
+	}
+	return nil
+}
+
+func NewTemplateArchive(config ArchiveConfig, clk clock) (*TemplateArchive, error) {
+	db, err := openArchiveDB(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	if config.RetentionHours == 0 {
+		config.RetentionHours = 7 * 24
+	}
+	return &TemplateArchive{
+		clock:     clk,
+		db:        db,
+		retention: time.Duration(config.RetentionHours) * time.Hour,
+		records:   make(chan *historyRecord, 1024),
+	}, nil
+}
+
+func (a *TemplateArchive) Record(record *historyRecord) {
+	select {
+	case a.records <- record:
+	default:
+		log.Printf("template archive queue full, dropping %s", record.Fingerprint)
+	}
+}
+
+func (a *TemplateArchive) QueueDepth() int {
+	return len(a.records)
+}
+
+func (a *TemplateArchive) Start() {
+	go func() {
+		prune, stop := a.clock.Tick(time.Hour)
+		defer stop()
+		a.prune()
+		for {
+			select {
+			case record := <-a.records:
+				if err := a.insert(record); err != nil {
+					log.Printf("error archiving template: %v", err)
+				}
+			case <-prune:
+				a.prune()
+			}
+		}
+	}()
+}
+
+func (a *TemplateArchive) insert(record *historyRecord) error {
+	_, err := a.db.Exec(`INSERT INTO templates (fingerprint, sequence, recorded_at, fetched_at, node, daa_score,
+		blue_score, bits, timestamp, tx_count, coinbase_value, merged_fees, fees, fetch_latency_ms, publish_latency_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Fingerprint, record.Sequence, record.PublishedAt, record.FetchedAt, record.Node, record.DAAScore,
+		record.BlueScore, record.Bits, record.Timestamp, record.TxCount, record.CoinbaseValue, record.MergedFees,
+		record.Fees, record.FetchLatencyMs, record.PublishLatencyMs)
+	return err
+}
+
+// readArchive calls fn for every archived record between from and to.
+func readArchive(db *sql.DB, from, to time.Time, fn func(*historyRecord) error) error {
+	rows, err := db.Query(`SELECT fingerprint, sequence, recorded_at, fetched_at, node, daa_score, blue_score, bits,
+		timestamp, tx_count, coinbase_value, merged_fees, fees, fetch_latency_ms, publish_latency_ms
+		FROM templates WHERE recorded_at BETWEEN ? AND ? ORDER BY recorded_at`,
+		from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return errors.Wrap(err, "failed reading template archive")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record historyRecord
+		err := rows.Scan(&record.Fingerprint, &record.Sequence, &record.PublishedAt, &record.FetchedAt, &record.Node,
+			&record.DAAScore, &record.BlueScore, &record.Bits, &record.Timestamp, &record.TxCount, &record.CoinbaseValue,
+			&record.MergedFees, &record.Fees, &record.FetchLatencyMs, &record.PublishLatencyMs)
+		if err != nil {
+			return err
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (a *TemplateArchive) prune() {
+	cutoff := a.clock.Now().Add(-a.retention).UnixMilli()
+	result, err := a.db.Exec(`DELETE FROM templates WHERE recorded_at < ?`, cutoff)
+	if err != nil {
+		log.Printf("error pruning template archive: %v", err)
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		log.Printf("pruned %d archived templates older than %v", removed, a.retention)
+	}
+}
+
+// archiveQueries are the canned questions the query command can answer.
+// Each takes the start of the time range (unix millis) as its only argument.
+var archiveQueries = map[string]string{
+	"rate": `SELECT strftime('%Y-%m-%d %H:%M', recorded_at / 1000, 'unixepoch') AS minute, node, COUNT(*) AS templates
+		FROM templates WHERE recorded_at >= ? GROUP BY minute, node ORDER BY minute, node`,
+	"latency": `SELECT node, COUNT(*) AS templates, AVG(fetch_latency_ms) AS avg_fetch_ms, MAX(fetch_latency_ms) AS max_fetch_ms,
+		AVG(publish_latency_ms) AS avg_publish_ms, MAX(publish_latency_ms) AS max_publish_ms
+		FROM templates WHERE recorded_at >= ? GROUP BY node ORDER BY node`,
+	"fees": `SELECT strftime('%Y-%m-%d %H:00', recorded_at / 1000, 'unixepoch') AS hour, node, AVG(tx_count) AS avg_txs,
+		AVG(fees) AS avg_fees, MAX(fees) AS max_fees
+		FROM templates WHERE recorded_at >= ? GROUP BY hour, node ORDER BY hour, node`,
+	"merged_fees": `SELECT strftime('%Y-%m-%d %H:00', recorded_at / 1000, 'unixepoch') AS hour, node, AVG(tx_count) AS avg_txs,
+		AVG(merged_fees) AS avg_merged_fees, MAX(merged_fees) AS max_merged_fees
+		FROM templates WHERE recorded_at >= ? GROUP BY hour, node ORDER BY hour, node`,
+}
+
+// runQuery implements the query command, printing the result of a canned or
+// raw SQL query against the archive as a table.
+func runQuery(config *BridgeConfig, args []string) error {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	since := flags.Duration("since", 24*time.Hour, "how far back to look")
+	rawSQL := flags.String("sql", "", "raw SQL to run instead of a named query")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.Archive.Path == "" {
+		return errors.New("no template archive configured")
+	}
+
+	query, queryArgs := *rawSQL, []interface{}{}
+	if query == "" {
+		name := flags.Arg(0)
+		var ok bool
+		if query, ok = archiveQueries[name]; !ok {
+			names := make([]string, 0, len(archiveQueries))
+			for name := range archiveQueries {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return errors.Errorf("unknown query %q, expected one of %s or -sql", name, strings.Join(names, ", "))
+		}
+		queryArgs = append(queryArgs, time.Now().Add(-*since).UnixMilli())
+	}
+
+	db, err := openArchiveReadOnly(config.Archive.Path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, queryArgs...)
+	if err != nil {
+		return errors.Wrap(err, "query failed")
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, strings.Join(columns, "\t"))
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		cells := make([]string, len(values))
+		for i, value := range values {
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			cells[i] = fmt.Sprint(value)
+		}
+		fmt.Fprintln(out, strings.Join(cells, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	archive, err := NewTemplateArchive(ArchiveConfig{Path: filepath.Join(t.TempDir(), "archive.db")}, newFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.db.Close()
+
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	now := time.Now()
+	envelope := &TemplateEnvelope{
+		Sequence:    7,
+		Fingerprint: "abc",
+		FetchedAt:   now.Add(-time.Second).UnixMilli(),
+		PublishedAt: now.UnixMilli(),
+	}
+	want := newHistoryRecord("node", envelope, template, 20*time.Millisecond)
+	want.Fees = 1234
+	if err := archive.insert(want); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*historyRecord
+	err = readArchive(archive.db, now.Add(-time.Minute), now.Add(time.Minute), func(record *historyRecord) error {
+		got = append(got, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || *got[0] != *want {
+		t.Fatalf("archive round trip changed the record:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestArchiveMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.db")
+	db, err := sql.Open(archiveDriver, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema of the first version, which recorded no version
+	_, err = db.Exec(`CREATE TABLE templates (fingerprint TEXT NOT NULL, recorded_at INTEGER NOT NULL,
+		node TEXT NOT NULL, daa_score INTEGER NOT NULL, blue_score INTEGER NOT NULL, bits INTEGER NOT NULL,
+		tx_count INTEGER NOT NULL, fees INTEGER NOT NULL, fetch_latency_ms REAL NOT NULL,
+		publish_latency_ms REAL NOT NULL);
+		INSERT INTO templates VALUES ('old', ?, 'node', 1, 2, 3, 4, 5, 6, 7)`, time.Now().UnixMilli())
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := NewTemplateArchive(ArchiveConfig{Path: path}, newFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.db.Close()
+	if version, err := archiveVersion(archive.db); err != nil || version != archiveSchemaVersion {
+		t.Fatalf("expected schema version %d after migrating, got %d (%v)", archiveSchemaVersion, version, err)
+	}
+	now := time.Now()
+	envelope := &TemplateEnvelope{Sequence: 1, Fingerprint: "new", FetchedAt: now.UnixMilli(), PublishedAt: now.UnixMilli()}
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	if err := archive.insert(newHistoryRecord("node", envelope, template, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*historyRecord
+	err = readArchive(archive.db, now.Add(-time.Minute), now.Add(time.Minute), func(record *historyRecord) error {
+		got = append(got, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Fingerprint != "old" || got[0].MergedFees != 5 || got[1].Fingerprint != "new" {
+		t.Fatalf("unexpected records after migrating: %+v", got)
+	}
+
+	if _, err := archive.db.Exec(`PRAGMA user_version = 99`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openArchiveDB(path); err == nil {
+		t.Fatal("expected an archive from a newer version to be refused")
+	}
+}
+
+func TestQueryIsReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.db")
+	archive, err := NewTemplateArchive(ArchiveConfig{Path: path}, newFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.db.Close()
+	now := time.Now()
+	envelope := &TemplateEnvelope{Sequence: 1, Fingerprint: "abc", FetchedAt: now.UnixMilli(), PublishedAt: now.UnixMilli()}
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	if err := archive.insert(newHistoryRecord("node", envelope, template, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &BridgeConfig{Archive: ArchiveConfig{Path: path}}
+	if err := runQuery(config, []string{"-sql", "DELETE FROM templates"}); err == nil {
+		t.Fatal("expected a write through -sql to fail")
+	}
+	var count int
+	if err := archive.db.QueryRow(`SELECT COUNT(*) FROM templates`).Scan(&count); err != nil || count != 1 {
+		t.Fatalf("expected the archived template to remain, got %d (%v)", count, err)
+	}
+	if err := runQuery(config, []string{"-sql", "SELECT COUNT(*) FROM templates"}); err != nil {
+		t.Fatal(err)
+	}
+}
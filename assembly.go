@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/merkle"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/transactionhelper"
+	"github.com/kaspanet/kaspad/domain/dagconfig"
+	"github.com/kaspanet/kaspad/util/txmass"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type AssemblyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Transactions are removed when their mass exceeds MaxTxMass, any output
+	// is below MinOutputSompi, they have more than MaxOutputs outputs or their
+	// ID is listed in ExcludeIDs. Zero values disable a rule.
+	MaxTxMass      uint64   `json:"max_tx_mass"`
+	MinOutputSompi uint64   `json:"min_output_sompi"`
+	MaxOutputs     int      `json:"max_outputs"`
+	ExcludeIDs     []string `json:"exclude_ids"`
+	// FallbackToOriginal publishes the node's template when the assembled
+	// one fails validation instead of failing the fetch
+	FallbackToOriginal bool `json:"fallback_to_original"`
+	// Originals of modified templates are kept under AuditKeyPrefix plus the
+	// published fingerprint
+	AuditKeyPrefix  string `json:"audit_key_prefix"`
+	AuditTTLSeconds int64  `json:"audit_ttl_seconds"`
+}
+
+const (
+	ruleMaxTxMass        = "max_tx_mass"
+	ruleMinOutput        = "min_output_sompi"
+	ruleMaxOutputs       = "max_outputs"
+	ruleExcluded         = "exclude_ids"
+	ruleDependsOnRemoved = "depends_on_removed"
+)
+
+type removedTransaction struct {
+	ID   string `json:"id"`
+	Rule string `json:"rule"`
+}
+
+// assemblyReport describes how a published template differs from the one the
+// node returned.
+type assemblyReport struct {
+	OriginalFingerprint string               `json:"original_fingerprint"`
+	OriginalTxCount     int                  `json:"original_tx_count"`
+	TxCount             int                  `json:"tx_count"`
+	OriginalMass        uint64               `json:"original_mass"`
+	Mass                uint64               `json:"mass"`
+	Removed             []removedTransaction `json:"removed"`
+}
+
+func networkParams(network string) (*dagconfig.Params, error) {
+	switch network {
+	case "mainnet":
+		return &dagconfig.MainnetParams, nil
+	case "testnet-10", "testnet-11":
+		return &dagconfig.TestnetParams, nil
+	default:
+		return nil, errors.Errorf("no consensus parameters for network %q", network)
+	}
+}
+
+// blockAssembler removes transactions from node templates by policy. Only the
+// hash merkle root depends on the block's own transactions: the accepted ID
+// merkle root, UTXO commitment and coinbase all commit to the merged blocks,
+// so they stay valid when transactions are left out.
+type blockAssembler struct {
+	config       AssemblyConfig
+	rdb          *redis.Client
+	calculator   *txmass.Calculator
+	maxBlockMass uint64
+	exclude      map[string]bool
+
+	mutex      sync.Mutex
+	removed    map[string]uint64
+	assembled  uint64
+	rejected   uint64
+	lastReport *assemblyReport
+}
+
+func newBlockAssembler(config AssemblyConfig, network string, rdb *redis.Client) (*blockAssembler, error) {
+	params, err := networkParams(network)
+	if err != nil {
+		return nil, err
+	}
+	if config.AuditTTLSeconds == 0 {
+		config.AuditTTLSeconds = 24 * 60 * 60
+	}
+	exclude := make(map[string]bool, len(config.ExcludeIDs))
+	for _, id := range config.ExcludeIDs {
+		exclude[id] = true
+	}
+	return &blockAssembler{
+		config:       config,
+		rdb:          rdb,
+		calculator:   txmass.NewCalculator(params.MassPerTxByte, params.MassPerScriptPubKeyByte, params.MassPerSigOp),
+		maxBlockMass: params.MaxBlockMass,
+		exclude:      exclude,
+		removed:      make(map[string]uint64),
+	}, nil
+}
+
+func (a *blockAssembler) mass(tx *externalapi.DomainTransaction) uint64 {
+	if tx.Mass != 0 {
+		return tx.Mass
+	}
+	return a.calculator.CalculateTransactionMass(tx)
+}
+
+// rule returns the rule excluding tx, if any.
+func (a *blockAssembler) rule(tx *externalapi.DomainTransaction, id string, mass uint64) string {
+	if a.exclude[id] {
+		return ruleExcluded
+	}
+	if a.config.MaxTxMass != 0 && mass > a.config.MaxTxMass {
+		return ruleMaxTxMass
+	}
+	if a.config.MaxOutputs != 0 && len(tx.Outputs) > a.config.MaxOutputs {
+		return ruleMaxOutputs
+	}
+	for _, output := range tx.Outputs {
+		if output.Value < a.config.MinOutputSompi {
+			return ruleMinOutput
+		}
+	}
+	return ""
+}
+
+// Assemble returns template with the transactions excluded by policy removed
+// and the header updated to match. A nil report means nothing was removed and
+// template is returned as is.
+func (a *blockAssembler) Assemble(template *appmessage.GetBlockTemplateResponseMessage) (
+	*appmessage.GetBlockTemplateResponseMessage, *assemblyReport, error) {
+
+	block, err := appmessage.RPCBlockToDomainBlock(template.Block)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error converting template")
+	}
+	if len(block.Transactions) == 0 || !transactionhelper.IsCoinBase(block.Transactions[0]) {
+		return nil, nil, errors.New("template does not start with a coinbase transaction")
+	}
+
+	ids := make([]string, len(block.Transactions))
+	masses := make([]uint64, len(block.Transactions))
+	removed := make(map[string]string)
+	var originalMass uint64
+	for i, tx := range block.Transactions {
+		ids[i] = consensushashing.TransactionID(tx).String()
+		masses[i] = a.mass(tx)
+		originalMass += masses[i]
+		if i == 0 {
+			continue
+		}
+		if rule := a.rule(tx, ids[i], masses[i]); rule != "" {
+			removed[ids[i]] = rule
+		}
+	}
+	if len(removed) == 0 {
+		return template, nil, nil
+	}
+	// Spending a removed transaction's outputs would leave a dangling input,
+	// repeat until no remaining transaction depends on a removed one
+	for changed := true; changed; {
+		changed = false
+		for i, tx := range block.Transactions[1:] {
+			if _, ok := removed[ids[i+1]]; ok {
+				continue
+			}
+			for _, input := range tx.Inputs {
+				if _, ok := removed[input.PreviousOutpoint.TransactionID.String()]; ok {
+					removed[ids[i+1]] = ruleDependsOnRemoved
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	report := &assemblyReport{
+		OriginalFingerprint: templateFingerprint(template),
+		OriginalTxCount:     len(block.Transactions),
+		OriginalMass:        originalMass,
+	}
+	var kept []*appmessage.RPCTransaction
+	var keptDomain []*externalapi.DomainTransaction
+	for i, tx := range block.Transactions {
+		if rule, ok := removed[ids[i]]; ok {
+			report.Removed = append(report.Removed, removedTransaction{ID: ids[i], Rule: rule})
+			continue
+		}
+		kept = append(kept, template.Block.Transactions[i])
+		keptDomain = append(keptDomain, tx)
+		report.Mass += masses[i]
+	}
+	report.TxCount = len(kept)
+
+	header := *template.Block.Header
+	header.HashMerkleRoot = merkle.CalculateHashMerkleRoot(keptDomain).String()
+	assembled := *template
+	assembled.Block = &appmessage.RPCBlock{Header: &header, Transactions: kept}
+
+	if err := a.validate(&assembled, removed); err != nil {
+		a.mutex.Lock()
+		a.rejected++
+		a.mutex.Unlock()
+		return nil, nil, errors.Wrap(err, "assembled template failed validation")
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.assembled++
+	for _, tx := range report.Removed {
+		a.removed[tx.Rule]++
+	}
+	a.lastReport = report
+	return &assembled, report, nil
+}
+
+// validate checks the assembled block is consistent on its own: it converts
+// cleanly, starts with the coinbase, has no duplicate or dangling
+// transactions, commits to its transactions and fits the block mass limit.
+func (a *blockAssembler) validate(template *appmessage.GetBlockTemplateResponseMessage, removed map[string]string) error {
+	block, err := appmessage.RPCBlockToDomainBlock(template.Block)
+	if err != nil {
+		return err
+	}
+	if len(block.Transactions) == 0 || !transactionhelper.IsCoinBase(block.Transactions[0]) {
+		return errors.New("missing coinbase transaction")
+	}
+	seen := make(map[string]bool, len(block.Transactions))
+	var mass uint64
+	for _, tx := range block.Transactions {
+		id := consensushashing.TransactionID(tx).String()
+		if seen[id] {
+			return errors.Errorf("duplicate transaction %s", id)
+		}
+		if _, ok := removed[id]; ok {
+			return errors.Errorf("removed transaction %s is still included", id)
+		}
+		seen[id] = true
+		for _, input := range tx.Inputs {
+			if _, ok := removed[input.PreviousOutpoint.TransactionID.String()]; ok {
+				return errors.Errorf("transaction %s spends removed transaction %s", id, input.PreviousOutpoint.TransactionID)
+			}
+		}
+		mass += a.mass(tx)
+	}
+	if mass > a.maxBlockMass {
+		return errors.Errorf("block mass %d exceeds the limit of %d", mass, a.maxBlockMass)
+	}
+	if !block.Header.HashMerkleRoot().Equal(merkle.CalculateHashMerkleRoot(block.Transactions)) {
+		return errors.New("hash merkle root does not match the transactions")
+	}
+	return nil
+}
+
+// Audit stores the node's original template under the fingerprint of the
+// template published in its place.
+func (a *blockAssembler) Audit(ctx context.Context, fingerprint string,
+	original *appmessage.GetBlockTemplateResponseMessage) error {
+
+	if a.config.AuditKeyPrefix == "" {
+		return nil
+	}
+	data, err := json.Marshal(original)
+	if err != nil {
+		return errors.Wrap(err, "error serializing original template")
+	}
+	ttl := time.Duration(a.config.AuditTTLSeconds) * time.Second
+	if err := a.rdb.Set(ctx, a.config.AuditKeyPrefix+fingerprint, data, ttl).Err(); err != nil {
+		return errors.Wrap(err, "error storing original template")
+	}
+	return nil
+}
+
+func (a *blockAssembler) writeMetrics(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, rule := range []string{ruleExcluded, ruleMaxTxMass, ruleMaxOutputs, ruleMinOutput, ruleDependsOnRemoved} {
+		fmt.Fprintf(w, "katpool_assembly_removed_transactions_total{rule=%q} %d\n", rule, a.removed[rule])
+	}
+	fmt.Fprintf(w, "katpool_assembly_templates_total %d\n", a.assembled)
+	fmt.Fprintf(w, "katpool_assembly_rejected_total %d\n", a.rejected)
+}
+
+func (a *blockAssembler) statusSection() interface{} {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return map[string]interface{}{
+		"assembled":   a.assembled,
+		"rejected":    a.rejected,
+		"last_report": a.lastReport,
+	}
+}
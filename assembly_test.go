@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/dagconfig"
+)
+
+func newTestAssembler(t *testing.T, config AssemblyConfig, network string) *blockAssembler {
+	t.Helper()
+	assembler, err := newBlockAssembler(config, network, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assembler
+}
+
+func TestBlockAssemblerRemovesByPolicy(t *testing.T) {
+	template := loadSyntheticTemplate(t, "many-parents.json")
+	ids, err := transactionIDs(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the fifth transaction spend the excluded fourth one
+	template.Block.Transactions[5].Inputs[0].PreviousOutpoint.TransactionID = ids[4]
+	ids, err = transactionIDs(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalRoot := template.Block.Header.HashMerkleRoot
+	originalCount := len(template.Block.Transactions)
+
+	assembler := newTestAssembler(t, AssemblyConfig{Enabled: true, ExcludeIDs: []string{ids[4]}}, "mainnet")
+	assembled, report, err := assembler.Assemble(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.TxCount != originalCount-2 || len(assembled.Block.Transactions) != originalCount-2 {
+		t.Fatalf("expected two transactions removed, got %+v", report)
+	}
+	if report.Removed[0].Rule != ruleExcluded || report.Removed[1].Rule != ruleDependsOnRemoved {
+		t.Fatalf("unexpected removal rules %+v", report.Removed)
+	}
+	if report.Mass >= report.OriginalMass || report.OriginalFingerprint != templateFingerprint(template) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if assembled.Block.Header.HashMerkleRoot == originalRoot || templateFingerprint(assembled) == report.OriginalFingerprint {
+		t.Fatalf("header not updated for the removed transactions")
+	}
+	if template.Block.Header.HashMerkleRoot != originalRoot || len(template.Block.Transactions) != originalCount {
+		t.Fatalf("original template was modified")
+	}
+	if err := assembler.validate(assembled, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The synthetic 300 transaction fixture is over the block mass limit
+	heavy := loadSyntheticTemplate(t, "many-txs.json")
+	heavyIDs, err := transactionIDs(heavy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembler = newTestAssembler(t, AssemblyConfig{Enabled: true, ExcludeIDs: heavyIDs[1:2]}, "mainnet")
+	if _, _, err := assembler.Assemble(heavy); err == nil {
+		t.Fatalf("assembled template over the mass limit passed validation")
+	}
+
+	// Nothing to remove leaves the template alone
+	unchanged, report, err := newTestAssembler(t, AssemblyConfig{Enabled: true}, "mainnet").Assemble(template)
+	if err != nil || report != nil || unchanged != template {
+		t.Fatalf("template without removals should pass through, got %+v, %v", report, err)
+	}
+}
+
+// capturedNetwork returns the network a captured template was recorded on,
+// which prefixes its file name.
+func capturedNetwork(t *testing.T, name string) string {
+	t.Helper()
+	for _, network := range []string{"mainnet", "testnet-10", "testnet-11"} {
+		if strings.HasPrefix(name, network+"-") {
+			return network
+		}
+	}
+	t.Fatalf("%s: captured template without a network prefix", name)
+	return ""
+}
+
+func TestBlockAssemblerCapturedTemplates(t *testing.T) {
+	for name, template := range capturedTemplates(t) {
+		network := capturedNetwork(t, name)
+		assembler := newTestAssembler(t, AssemblyConfig{Enabled: true}, network)
+		if err := assembler.validate(template, nil); err != nil {
+			t.Fatalf("%s: node template does not validate: %v", name, err)
+		}
+		ids, err := transactionIDs(template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) < 2 {
+			continue
+		}
+
+		assembler = newTestAssembler(t, AssemblyConfig{Enabled: true, ExcludeIDs: ids[len(ids)-1:]}, network)
+		assembled, report, err := assembler.Assemble(template)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if report == nil || len(report.Removed) == 0 || report.Mass >= report.OriginalMass {
+			t.Fatalf("%s: unexpected report %+v", name, report)
+		}
+		if assembled.Block.Header.AcceptedIDMerkleRoot != template.Block.Header.AcceptedIDMerkleRoot ||
+			assembled.Block.Header.UTXOCommitment != template.Block.Header.UTXOCommitment {
+			t.Fatalf("%s: commitments to the merged blocks changed", name)
+		}
+	}
+}
+
+// The genesis blocks are real blocks, so they check the merkle root and mass
+// calculations against consensus data.
+func TestBlockAssemblerValidatesGenesisBlocks(t *testing.T) {
+	for network, params := range map[string]*dagconfig.Params{
+		"mainnet":    &dagconfig.MainnetParams,
+		"testnet-10": &dagconfig.TestnetParams,
+	} {
+		template := &appmessage.GetBlockTemplateResponseMessage{Block: appmessage.DomainBlockToRPCBlock(params.GenesisBlock)}
+		if err := newTestAssembler(t, AssemblyConfig{Enabled: true}, network).validate(template, nil); err != nil {
+			t.Fatalf("%s genesis block does not validate: %v", network, err)
+		}
+	}
+}
+
+func TestNetworkParamsRejectsUnknownNetworks(t *testing.T) {
+	for _, network := range []string{"", "devnet", "simnet", "testnet-12"} {
+		if _, err := newBlockAssembler(AssemblyConfig{Enabled: true}, network, nil); err == nil {
+			t.Errorf("assembler created for network %q", network)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"getNewBlockTemplate/consumer"
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/server/grpcserver/protowire"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+)
+
+type CanaryConfig struct {
+	Enabled          bool  `json:"enabled"`
+	LateThresholdMs  int64 `json:"late_threshold_ms"`
+	MissingTimeoutMs int64 `json:"missing_timeout_ms"`
+}
+
+func (c *CanaryConfig) validate() error {
+	if err := checkRange("canary.late_threshold_ms", c.LateThresholdMs, maxConfigMs); err != nil {
+		return err
+	}
+	return checkRange("canary.missing_timeout_ms", c.MissingTimeoutMs, maxConfigMs)
+}
+
+type pendingDelivery struct {
+	fetchedAt time.Time
+	late      bool
+}
+
+// canaryDecoder extracts what a canary tracks from a message received on its
+// channel: the key the message was expected under, empty for messages the
+// canary ignores, and its sequence number when it carries one.
+type canaryDecoder func(payload []byte) (key string, sequence uint64, err error)
+
+// DeliveryCanary subscribes to a channel the fetcher publishes on and checks
+// that every published message actually comes back, measuring the time from
+// fetch to delivery. Templates and diffs are matched by fingerprint and
+// heartbeats by send time; when messages carry a sequence it is also checked
+// for gaps.
+type DeliveryCanary struct {
+	clock          clock
+	channel        string
+	decode         canaryDecoder
+	lateThreshold  time.Duration
+	missingTimeout time.Duration
+	latency        *histogram
+	reassembler    *consumer.Reassembler
+
+	mutex        sync.Mutex
+	subscribed   bool
+	pending      map[string]*pendingDelivery
+	lastSequence uint64
+	delivered    uint64
+	late         uint64
+	missing      uint64
+}
+
+// NewDeliveryCanary returns a canary for the primary template channel.
+func NewDeliveryCanary(channel string, config CanaryConfig, clk clock) *DeliveryCanary {
+	return newCanary(channel, templateDecoder(ChannelConfig{}), config, clk)
+}
+
+// NewChannelCanary returns a canary for a channel publishing templates with
+// the given profile.
+func NewChannelCanary(profile ChannelConfig, config CanaryConfig, clk clock) *DeliveryCanary {
+	return newCanary(profile.RedisChannel, templateDecoder(profile), config, clk)
+}
+
+// NewDiffCanary returns a canary for the template diff channel.
+func NewDiffCanary(channel string, config CanaryConfig, clk clock) *DeliveryCanary {
+	return newCanary(channel, decodeDiff, config, clk)
+}
+
+// NewHeartbeatCanary returns a canary for a dedicated heartbeat channel.
+func NewHeartbeatCanary(channel string, config CanaryConfig, clk clock) *DeliveryCanary {
+	return newCanary(channel, decodeHeartbeat, config, clk)
+}
+
+func newCanary(channel string, decode canaryDecoder, config CanaryConfig, clk clock) *DeliveryCanary {
+	if config.LateThresholdMs == 0 {
+		config.LateThresholdMs = 1000
+	}
+	if config.MissingTimeoutMs == 0 {
+		config.MissingTimeoutMs = 10000
+	}
+	return &DeliveryCanary{
+		clock:          clk,
+		channel:        channel,
+		decode:         decode,
+		lateThreshold:  time.Duration(config.LateThresholdMs) * time.Millisecond,
+		missingTimeout: time.Duration(config.MissingTimeoutMs) * time.Millisecond,
+		latency:        newHistogram(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+		pending:        make(map[string]*pendingDelivery),
+		reassembler:    consumer.NewReassembler(0),
+	}
+}
+
+// Expect registers a template that is about to be published.
+func (c *DeliveryCanary) Expect(envelope *TemplateEnvelope) {
+	c.expect(envelope.Fingerprint, time.UnixMilli(envelope.FetchedAt))
+}
+
+// Cancel forgets a template whose publish call failed, the publish error is
+// already reported by the caller.
+func (c *DeliveryCanary) Cancel(envelope *TemplateEnvelope) {
+	c.cancel(envelope.Fingerprint)
+}
+
+// expect registers a message about to be published under key, its delivery
+// latency counts from since.
+func (c *DeliveryCanary) expect(key string, since time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending[key] = &pendingDelivery{fetchedAt: since}
+}
+
+func (c *DeliveryCanary) cancel(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.pending, key)
+}
+
+// Pending returns the number of published messages not delivered yet.
+func (c *DeliveryCanary) Pending() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending)
+}
+
+func (c *DeliveryCanary) Start(ctx context.Context, rdb *redis.Client) {
+	sub := rdb.Subscribe(ctx, c.channel)
+	go func() {
+		defer sub.Close()
+		for msg := range sub.ChannelWithSubscriptions(ctx, 100) {
+			c.handle(msg, c.clock.Now())
+		}
+	}()
+	go func() {
+		ticks, stop := c.clock.Tick(time.Second)
+		defer stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticks:
+				c.sweep(now)
+			}
+		}
+	}()
+	metrics.Register(c.writeMetrics)
+}
+
+// Subscribed reports whether Redis confirmed the canary's subscription, from
+// then on every publish on the channel counts the canary as a receiver.
+func (c *DeliveryCanary) Subscribed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.subscribed
+}
+
+func (c *DeliveryCanary) handle(msg interface{}, now time.Time) {
+	switch msg := msg.(type) {
+	case *redis.Subscription:
+		c.mutex.Lock()
+		c.subscribed = msg.Kind == "subscribe"
+		c.mutex.Unlock()
+	case *redis.Message:
+		c.received([]byte(msg.Payload), now)
+	}
+}
+
+func (c *DeliveryCanary) received(payload []byte, now time.Time) {
+	payload, err := c.reassembler.Add(payload)
+	if err != nil {
+		log.Printf("ALERT canary: %s: %v", c.channel, err)
+		return
+	}
+	if payload == nil {
+		// Waiting for the rest of a chunked template
+		return
+	}
+
+	key, sequence, err := c.decode(payload)
+	if err != nil {
+		log.Printf("canary: undecodable message on %s: %v", c.channel, err)
+		return
+	}
+	if key == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if sequence != 0 {
+		if c.lastSequence != 0 && sequence > c.lastSequence+1 {
+			log.Printf("ALERT canary: %s skipped sequence %d..%d", c.channel, c.lastSequence+1, sequence-1)
+		}
+		c.lastSequence = sequence
+	}
+
+	pending, ok := c.pending[key]
+	if !ok {
+		// Published by someone else, or already given up on
+		return
+	}
+	delete(c.pending, key)
+	c.delivered++
+	c.latency.Observe(now.Sub(pending.fetchedAt).Seconds())
+}
+
+// templateDecoder decodes templates published with the given profile, keyed
+// by fingerprint. Heartbeats sharing the template channel are ignored.
+func templateDecoder(profile ChannelConfig) canaryDecoder {
+	return func(payload []byte) (string, uint64, error) {
+		if profile.Compression == compressionGzip {
+			reader, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return "", 0, err
+			}
+			if payload, err = io.ReadAll(reader); err != nil {
+				return "", 0, err
+			}
+		}
+		if profile.Encoding == encodingProtobuf {
+			var message protowire.KaspadMessage
+			if err := proto.Unmarshal(payload, &message); err != nil {
+				return "", 0, err
+			}
+			appMessage, err := message.ToAppMessage()
+			if err != nil {
+				return "", 0, err
+			}
+			template, ok := appMessage.(*appmessage.GetBlockTemplateResponseMessage)
+			if !ok {
+				return "", 0, errors.Errorf("unexpected %s message", appMessage.Command())
+			}
+			return templateFingerprint(template), 0, nil
+		}
+
+		var envelope TemplateEnvelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			return "", 0, err
+		}
+		if envelope.Type == messageTypeHeartbeat {
+			return "", 0, nil
+		}
+		if envelope.Template == nil {
+			// Envelopes are disabled, the payload is the bare template
+			var template appmessage.GetBlockTemplateResponseMessage
+			if err := json.Unmarshal(payload, &template); err != nil {
+				return "", 0, err
+			}
+			return templateFingerprint(&template), 0, nil
+		}
+		return envelope.Fingerprint, envelope.Sequence, nil
+	}
+}
+
+func decodeDiff(payload []byte) (string, uint64, error) {
+	var diff TemplateDiff
+	if err := json.Unmarshal(payload, &diff); err != nil {
+		return "", 0, err
+	}
+	return diff.Fingerprint, diff.Sequence, nil
+}
+
+// heartbeatKey identifies a heartbeat to its canary by the time it was sent.
+func heartbeatKey(sentAt int64) string {
+	return fmt.Sprintf("heartbeat:%d", sentAt)
+}
+
+func decodeHeartbeat(payload []byte) (string, uint64, error) {
+	var heartbeat heartbeatMessage
+	if err := json.Unmarshal(payload, &heartbeat); err != nil {
+		return "", 0, err
+	}
+	if heartbeat.Type != messageTypeHeartbeat {
+		return "", 0, nil
+	}
+	return heartbeatKey(heartbeat.SentAt), 0, nil
+}
+
+func (c *DeliveryCanary) sweep(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for fingerprint, pending := range c.pending {
+		age := now.Sub(pending.fetchedAt)
+		if age > c.missingTimeout {
+			log.Printf("ALERT canary: template %s never delivered on %s (waited %v)", fingerprint, c.channel, age)
+			delete(c.pending, fingerprint)
+			c.missing++
+		} else if age > c.lateThreshold && !pending.late {
+			log.Printf("ALERT canary: template %s late on %s (%v since fetch)", fingerprint, c.channel, age)
+			pending.late = true
+			c.late++
+		}
+	}
+}
+
+func (c *DeliveryCanary) writeMetrics(w io.Writer) {
+	labels := fmt.Sprintf("channel=%q,", c.channel)
+	c.latency.WritePrometheus(w, "katpool_canary_delivery_latency_seconds", labels)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "katpool_canary_delivered_total{%s} %d\n", trimLabels(labels), c.delivered)
+	fmt.Fprintf(w, "katpool_canary_late_total{%s} %d\n", trimLabels(labels), c.late)
+	fmt.Fprintf(w, "katpool_canary_missing_total{%s} %d\n", trimLabels(labels), c.missing)
+	fmt.Fprintf(w, "katpool_canary_pending{%s} %d\n", trimLabels(labels), len(c.pending))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+// captureLabels are the fixture labels every network's capture set covers.
+var captureLabels = []string{"empty", "many-txs", "many-parents"}
+
+// minManyTxs is the fewest non-coinbase transactions a many-txs capture holds.
+const minManyTxs = 50
+
+// checkCaptureLabel refuses templates that don't have the shape their label
+// promises, so a capture made at a quiet moment doesn't end up mislabelled.
+func checkCaptureLabel(label string, template *appmessage.GetBlockTemplateResponseMessage) error {
+	block := template.Block
+	switch label {
+	case "empty":
+		if len(block.Transactions) != 1 {
+			return errors.Errorf("an empty template holds only the coinbase, this one has %d transactions",
+				len(block.Transactions))
+		}
+	case "many-txs":
+		if len(block.Transactions)-1 < minManyTxs {
+			return errors.Errorf("a many-txs template holds at least %d transactions, this one has %d",
+				minManyTxs, len(block.Transactions)-1)
+		}
+	case "many-parents":
+		if len(block.Header.Parents) < 2 || len(block.Header.Parents[0].ParentHashes) < 2 {
+			return errors.New("a many-parents template has several direct parents and parent levels")
+		}
+	}
+	return nil
+}
+
+// runCapture implements the capture command, saving the node's current block
+// template as a test fixture under testdata/templates.
+func runCapture(config *BridgeConfig, args []string) error {
+	flags := flag.NewFlagSet("capture", flag.ContinueOnError)
+	label := flags.String("label", "template", "fixture label, e.g. empty, many-txs or many-parents")
+	dir := flags.String("dir", filepath.Join("testdata", "templates"), "directory to write the fixture to")
+	node := flags.String("node", nodeAddress(config.Network), "kaspad RPC address")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	address, err := fetchKaspaAccountFromPrivateKey(config.Network, os.Getenv("TREASURY_PRIVATE_KEY"))
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve address from private key")
+	}
+	ksApi, err := NewKaspaAPI(*node, 0)
+	if err != nil {
+		return err
+	}
+	template, err := ksApi.GetBlockTemplate(address)
+	if err != nil {
+		return err
+	}
+
+	if err := checkCaptureLabel(*label, template); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s-%d.json", config.Network, *label, template.Block.Header.DAAScore)
+	path := filepath.Join(*dir, name)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Printf("captured template with %d transactions and %d parent levels to %s",
+		len(template.Block.Transactions), len(template.Block.Header.Parents), path)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/server/grpcserver/protowire"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// ChannelConfig describes an additional output channel. An enabled channel
+// with the other fields left empty publishes every template as JSON, like the
+// primary channel.
+type ChannelConfig struct {
+	Enabled       bool           `json:"enabled"`
+	RedisChannel  string         `json:"redis_channel"`
+	Envelope      bool           `json:"envelope"`
+	Encoding      string         `json:"encoding"`
+	Compression   string         `json:"compression"`
+	Content       string         `json:"content"`
+	MinIntervalMs int64          `json:"min_interval_ms"`
+	Filter        string         `json:"filter"`
+	Chunking      ChunkingConfig `json:"chunking"`
+}
+
+const (
+	encodingJSON     = "json"
+	encodingProtobuf = "protobuf"
+
+	compressionNone = "none"
+	compressionGzip = "gzip"
+
+	contentFull   = "full"
+	contentHeader = "header"
+
+	filterAll       = "all"
+	filterCleanJobs = "clean_jobs"
+)
+
+func (c *ChannelConfig) validate() error {
+	if c.RedisChannel == "" {
+		return errors.New("channel without redis_channel")
+	}
+	switch c.Encoding {
+	case "", encodingJSON:
+	case encodingProtobuf:
+		if c.Envelope {
+			return errors.Errorf("channel %s: envelopes require json encoding", c.RedisChannel)
+		}
+	default:
+		return errors.Errorf("channel %s: unknown encoding %q", c.RedisChannel, c.Encoding)
+	}
+	switch c.Compression {
+	case "", compressionNone, compressionGzip:
+	default:
+		return errors.Errorf("channel %s: unknown compression %q", c.RedisChannel, c.Compression)
+	}
+	switch c.Content {
+	case "", contentFull, contentHeader:
+	default:
+		return errors.Errorf("channel %s: unknown content %q", c.RedisChannel, c.Content)
+	}
+	switch c.Filter {
+	case "", filterAll, filterCleanJobs:
+	default:
+		return errors.Errorf("channel %s: unknown filter %q", c.RedisChannel, c.Filter)
+	}
+	if c.MinIntervalMs < 0 {
+		return errors.Errorf("channel %s: min_interval_ms must not be negative", c.RedisChannel)
+	}
+	if err := c.Chunking.validate(); err != nil {
+		return errors.Wrapf(err, "channel %s", c.RedisChannel)
+	}
+	return nil
+}
+
+// NewChannelPublisher returns a publisher shaping templates by the channel's
+// profile.
+func NewChannelPublisher(rdb *redis.Client, config ChannelConfig, clk clock) *TemplatePublisher {
+	publisher := NewTemplatePublisher(rdb, config.RedisChannel, config.Envelope, clk)
+	publisher.profile = config
+	publisher.chunking = config.Chunking
+	return publisher
+}
+
+// skip reports whether the profile drops a template, clean jobs and the
+// minimum interval are judged against the last message actually published on
+// the channel.
+func (p *TemplatePublisher) skip(cleanJobs bool, now time.Time) bool {
+	if p.profile.Filter == filterCleanJobs && !cleanJobs {
+		return true
+	}
+	minInterval := time.Duration(p.profile.MinIntervalMs) * time.Millisecond
+	return !p.lastPublishedAt.IsZero() && now.Sub(p.lastPublishedAt) < minInterval
+}
+
+func headerOnly(template *appmessage.GetBlockTemplateResponseMessage) *appmessage.GetBlockTemplateResponseMessage {
+	stripped := *template
+	stripped.Block = &appmessage.RPCBlock{Header: template.Block.Header, VerboseData: template.Block.VerboseData}
+	return &stripped
+}
+
+// encode renders the payload for envelope according to the profile.
+func (p *TemplatePublisher) encode(envelope *TemplateEnvelope) ([]byte, error) {
+	if p.profile.Content == contentHeader {
+		stripped := *envelope
+		stripped.Template = headerOnly(envelope.Template)
+		envelope = &stripped
+	}
+
+	var payload []byte
+	var err error
+	switch {
+	case p.profile.Encoding == encodingProtobuf:
+		var message *protowire.KaspadMessage
+		message, err = protowire.FromAppMessage(envelope.Template)
+		if err != nil {
+			return nil, errors.Wrap(err, "error converting template to protobuf")
+		}
+		payload, err = proto.Marshal(message)
+	case p.envelope:
+		payload, err = json.Marshal(envelope)
+	default:
+		payload, err = json.Marshal(envelope.Template)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error serializing template")
+	}
+
+	if p.profile.Compression == compressionGzip {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(payload); err != nil {
+			return nil, errors.Wrap(err, "error compressing template")
+		}
+		if err := writer.Close(); err != nil {
+			return nil, errors.Wrap(err, "error compressing template")
+		}
+		payload = buffer.Bytes()
+	}
+	return payload, nil
+}
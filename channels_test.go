@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/network/netadapter/server/grpcserver/protowire"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChannelProfileEncoding(t *testing.T) {
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	transactions := len(template.Block.Transactions)
+	envelope := &TemplateEnvelope{Type: messageTypeTemplate, Sequence: 1, Template: template}
+
+	headers := NewChannelPublisher(nil, ChannelConfig{RedisChannel: "headers", Envelope: true,
+		Compression: compressionGzip, Content: contentHeader}, newFakeClock())
+	payload, err := headers.encode(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TemplateEnvelope
+	if err := json.NewDecoder(reader).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Template.Block.Transactions) != 0 || templateFingerprint(decoded.Template) != templateFingerprint(template) {
+		t.Fatalf("header-only content should keep the header and drop transactions")
+	}
+	if len(template.Block.Transactions) != transactions {
+		t.Fatalf("encoding modified the published template")
+	}
+
+	protobuf := NewChannelPublisher(nil, ChannelConfig{RedisChannel: "protobuf", Encoding: encodingProtobuf}, newFakeClock())
+	payload, err = protobuf.encode(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message protowire.KaspadMessage
+	if err := proto.Unmarshal(payload, &message); err != nil {
+		t.Fatal(err)
+	}
+	appMessage, err := message.ToAppMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty fields come back as empty rather than nil slices, so compare
+	// what identifies the template
+	decodedTemplate := appMessage.(*appmessage.GetBlockTemplateResponseMessage)
+	decodedIDs, err := transactionIDs(decodedTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := transactionIDs(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if templateFingerprint(decodedTemplate) != templateFingerprint(template) || !reflect.DeepEqual(decodedIDs, ids) {
+		t.Fatalf("template changed across a protobuf round trip")
+	}
+}
+
+func TestChannelProfileSkips(t *testing.T) {
+	clk := newFakeClock()
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	publish := func(publisher *TemplatePublisher) *TemplateEnvelope {
+		t.Helper()
+		envelope, err := publisher.Publish(context.Background(), template, clk.Now(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return envelope
+	}
+
+	cleanJobs := newTestChannel(ChannelConfig{RedisChannel: "clean", Filter: filterCleanJobs}, clk)
+	if publish(cleanJobs) == nil || publish(cleanJobs) != nil {
+		t.Fatalf("clean_jobs filter should only pass clean jobs")
+	}
+
+	slow := newTestChannel(ChannelConfig{RedisChannel: "slow", MinIntervalMs: 1000}, clk)
+	first := publish(slow)
+	if first == nil || first.PublishedAt != clk.Now().UnixMilli() {
+		t.Fatalf("first template should be published at the clock's time, got %+v", first)
+	}
+	clk.Advance(500 * time.Millisecond)
+	if publish(slow) != nil {
+		t.Fatalf("template published within the minimum interval")
+	}
+	clk.Advance(500 * time.Millisecond)
+	if envelope := publish(slow); envelope == nil || envelope.PublishedAt != first.PublishedAt+1000 {
+		t.Fatalf("template not published once the minimum interval passed, got %+v", envelope)
+	}
+}
+
+// newTestChannel returns a channel publisher that accepts every message
+// instead of sending it to Redis.
+func newTestChannel(config ChannelConfig, clk clock) *TemplatePublisher {
+	publisher := NewChannelPublisher(nil, config, clk)
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		return 1, nil
+	}
+	return publisher
+}
+
+func TestChannelCanaries(t *testing.T) {
+	clk := newFakeClock()
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	envelope := &TemplateEnvelope{Type: messageTypeTemplate, Sequence: 1, Fingerprint: templateFingerprint(template),
+		FetchedAt: clk.Now().UnixMilli(), Template: template}
+
+	for _, profile := range []ChannelConfig{
+		{RedisChannel: "headers", Envelope: true, Compression: compressionGzip, Content: contentHeader},
+		{RedisChannel: "bare", Compression: compressionGzip, Content: contentHeader},
+		{RedisChannel: "protobuf", Encoding: encodingProtobuf, Compression: compressionGzip},
+	} {
+		channel := NewChannelPublisher(nil, profile, clk)
+		payload, err := channel.encode(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		canary := NewChannelCanary(profile, CanaryConfig{}, clk)
+		canary.Expect(envelope)
+		canary.received(payload, clk.Now())
+		if canary.delivered != 1 || canary.Pending() != 0 {
+			t.Errorf("template on %s not matched by its canary", profile.RedisChannel)
+		}
+	}
+}
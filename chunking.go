@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+
+	"getNewBlockTemplate/consumer"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// ChunkingConfig splits payloads larger than ThresholdBytes into chunks of at
+// most ChunkBytes, preceded by a manifest. Chunk data is base64 encoded in a
+// JSON message, which must still fit in ThresholdBytes; ChunkBytes defaults to
+// the largest chunk that does.
+type ChunkingConfig struct {
+	ThresholdBytes int `json:"threshold_bytes"`
+	ChunkBytes     int `json:"chunk_bytes"`
+}
+
+func (c *ChunkingConfig) validate() error {
+	if c.ThresholdBytes < 0 || c.ChunkBytes < 0 {
+		return errors.New("chunking sizes must not be negative")
+	}
+	if c.ThresholdBytes == 0 {
+		return nil
+	}
+	if c.chunkBytes() <= 0 {
+		return errors.Errorf("chunking threshold_bytes %d cannot hold a chunk message", c.ThresholdBytes)
+	}
+	if size := consumer.ChunkMessageSize(c.ChunkBytes, fingerprintLength); size > c.ThresholdBytes {
+		return errors.Errorf("chunk_bytes %d makes %d byte messages, over threshold_bytes %d",
+			c.ChunkBytes, size, c.ThresholdBytes)
+	}
+	return nil
+}
+
+// chunkBytes returns the size to cut chunks at.
+func (c *ChunkingConfig) chunkBytes() int {
+	if c.ChunkBytes > 0 {
+		return c.ChunkBytes
+	}
+	return consumer.MaxChunkSize(c.ThresholdBytes, fingerprintLength)
+}
+
+// chunk returns the messages carrying payload, the payload itself when it is
+// under the threshold, otherwise a manifest followed by the chunks.
+func (p *TemplatePublisher) chunk(payload []byte, envelope *TemplateEnvelope) ([][]byte, error) {
+	if p.chunking.ThresholdBytes == 0 || len(payload) <= p.chunking.ThresholdBytes {
+		return [][]byte{payload}, nil
+	}
+	if len(payload) > consumer.DefaultMaxSize {
+		return nil, errors.Errorf("payload of %d bytes is over the %d bytes consumers accept", len(payload), consumer.DefaultMaxSize)
+	}
+	manifest, chunks := consumer.Split(payload, envelope.Sequence, envelope.Fingerprint, p.chunking.chunkBytes())
+	if len(chunks) > consumer.DefaultMaxChunks {
+		return nil, errors.Errorf("payload needs %d chunks, consumers accept %d", len(chunks), consumer.DefaultMaxChunks)
+	}
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "error serializing chunk manifest")
+	}
+	messages := [][]byte{encoded}
+	for _, chunk := range chunks {
+		encoded, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, errors.Wrap(err, "error serializing chunk")
+		}
+		messages = append(messages, encoded)
+	}
+	return messages, nil
+}
+
+// publishMessages publishes messages in order in a single round trip and
+// returns the number of subscribers that received the first one.
+func (p *TemplatePublisher) publishMessages(ctx context.Context, messages [][]byte) (int64, error) {
+	if len(messages) == 1 {
+		return p.rdb.Publish(ctx, p.channel, messages[0]).Result()
+	}
+	var first *redis.IntCmd
+	_, err := p.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, message := range messages {
+			cmd := pipe.Publish(ctx, p.channel, message)
+			if i == 0 {
+				first = cmd
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return first.Val(), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestChunkedTemplateReachesCanary(t *testing.T) {
+	clk := newFakeClock()
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	envelope := &TemplateEnvelope{Type: messageTypeTemplate, Sequence: 1, Fingerprint: templateFingerprint(template),
+		FetchedAt: clk.Now().UnixMilli(), Template: template}
+
+	for _, chunking := range []ChunkingConfig{{ThresholdBytes: 16384, ChunkBytes: 8192}, {ThresholdBytes: 16384}} {
+		if err := chunking.validate(); err != nil {
+			t.Fatal(err)
+		}
+		publisher := NewTemplatePublisher(nil, "channel", true, clk)
+		publisher.SetChunking(chunking)
+		payload, err := publisher.encode(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := publisher.chunk(payload, envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkBytes := chunking.chunkBytes()
+		if len(messages) != 2+(len(payload)-1)/chunkBytes {
+			t.Fatalf("expected a manifest and %d chunks, got %d messages", 1+(len(payload)-1)/chunkBytes, len(messages))
+		}
+		for i, message := range messages {
+			if len(message) > chunking.ThresholdBytes {
+				t.Fatalf("message %d of %d bytes is over the threshold", i, len(message))
+			}
+		}
+
+		canary := NewDeliveryCanary("channel", CanaryConfig{}, clk)
+		canary.Expect(envelope)
+		// Deliver the manifest last to check chunks are held until it arrives
+		for _, message := range append(messages[1:], messages[0]) {
+			canary.received(message, clk.Now())
+		}
+		if canary.delivered != 1 || canary.Pending() != 0 {
+			t.Fatalf("chunked template not delivered intact")
+		}
+	}
+}
+
+func TestChunkingConfigRejectsOversizedChunks(t *testing.T) {
+	for _, chunking := range []ChunkingConfig{{ThresholdBytes: 16384, ChunkBytes: 16384}, {ThresholdBytes: 64}} {
+		if err := chunking.validate(); err == nil {
+			t.Errorf("chunking %+v accepted", chunking)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// clock is the source of time for everything with timing behaviour, so tests
+// can substitute a fake clock and advance it deterministically.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// Tick returns a channel receiving the time every d, and a function
+	// stopping it.
+	Tick(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type fakeTimer struct {
+	at      time.Time
+	period  time.Duration
+	ch      chan time.Time
+	stopped bool
+}
+
+// fakeClock only moves when Advance is called, firing every timer and ticker
+// that comes due on the way in order.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{at: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).ch
+}
+
+func (c *fakeClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	timer := c.add(d, d)
+	return timer.ch, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		timer.stopped = true
+	}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	target := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.at.After(target) && (next == nil || timer.at.Before(next.at)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.at
+		select {
+		case next.ch <- c.now:
+		default:
+		}
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			next.stopped = true
+		}
+	}
+	c.now = target
+}
+
+// waitForTimer waits until a timer or ticker comes due within d, so a test
+// can advance the clock knowing the code under test is waiting on it.
+func (c *fakeClock) waitForTimer(d time.Duration) {
+	for {
+		c.mutex.Lock()
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.at.After(c.now.Add(d)) {
+				c.mutex.Unlock()
+				return
+			}
+		}
+		c.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,317 @@
+// Package consumer contains helpers for services reading the block template
+// feed published by the fetcher.
+package consumer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MessageTypeManifest = "manifest"
+	MessageTypeChunk    = "chunk"
+)
+
+// Default limits of a Reassembler, far above the size of any block template.
+const (
+	DefaultMaxSize   = 32 << 20
+	DefaultMaxChunks = 4096
+)
+
+// Manifest announces a payload split into chunks. It is published before
+// the chunks, which carry the same sequence and fingerprint.
+type Manifest struct {
+	Type        string `json:"type"`
+	Sequence    uint64 `json:"sequence"`
+	Fingerprint string `json:"fingerprint"`
+	Chunks      int    `json:"chunks"`
+	// ChunkSize is the size of every chunk but the last, which may be shorter
+	ChunkSize int    `json:"chunk_size"`
+	Size      int    `json:"size"`
+	Checksum  string `json:"checksum"`
+}
+
+// Chunk carries one piece of a payload, base64 encoded on the wire.
+type Chunk struct {
+	Type        string `json:"type"`
+	Sequence    uint64 `json:"sequence"`
+	Fingerprint string `json:"fingerprint"`
+	Index       int    `json:"index"`
+	Data        []byte `json:"data"`
+}
+
+// Checksum returns the hex encoded sha256 of payload.
+func Checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Split cuts payload into chunks of at most chunkSize bytes.
+func Split(payload []byte, sequence uint64, fingerprint string, chunkSize int) (*Manifest, []*Chunk) {
+	var chunks []*Chunk
+	for offset := 0; offset < len(payload); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunks = append(chunks, &Chunk{
+			Type:        MessageTypeChunk,
+			Sequence:    sequence,
+			Fingerprint: fingerprint,
+			Index:       len(chunks),
+			Data:        payload[offset:end],
+		})
+	}
+	manifest := &Manifest{
+		Type:        MessageTypeManifest,
+		Sequence:    sequence,
+		Fingerprint: fingerprint,
+		Chunks:      len(chunks),
+		ChunkSize:   chunkSize,
+		Size:        len(payload),
+		Checksum:    Checksum(payload),
+	}
+	return manifest, chunks
+}
+
+// chunkFraming returns the size of a chunk message with empty data, for the
+// largest sequence and index and a fingerprint of fingerprintLen characters.
+func chunkFraming(fingerprintLen int) int {
+	framing, _ := json.Marshal(&Chunk{
+		Type:        MessageTypeChunk,
+		Sequence:    math.MaxUint64,
+		Fingerprint: strings.Repeat("f", fingerprintLen),
+		Index:       math.MaxInt32,
+	})
+	return len(framing)
+}
+
+// ChunkMessageSize returns an upper bound on the size of the message carrying
+// a chunk of chunkSize bytes, including base64 and JSON framing.
+func ChunkMessageSize(chunkSize, fingerprintLen int) int {
+	return chunkFraming(fingerprintLen) + base64.StdEncoding.EncodedLen(chunkSize)
+}
+
+// MaxChunkSize returns the largest chunk whose message fits in messageSize
+// bytes, zero or less when not even an empty chunk fits.
+func MaxChunkSize(messageSize, fingerprintLen int) int {
+	available := messageSize - chunkFraming(fingerprintLen)
+	if available < 4 {
+		return available
+	}
+	return base64.StdEncoding.DecodedLen(available - available%4)
+}
+
+type chunkKey struct {
+	sequence    uint64
+	fingerprint string
+}
+
+type partialPayload struct {
+	manifest *Manifest
+	chunks   map[int][]byte
+	size     int
+}
+
+// Reassembler rebuilds chunked payloads from the messages of a channel. It
+// tolerates chunks arriving before their manifest and keeps at most
+// maxPending incomplete payloads, dropping the oldest beyond that. Payloads
+// over maxSize bytes or maxChunks chunks are rejected before anything is
+// allocated for them.
+type Reassembler struct {
+	maxPending int
+	maxSize    int
+	maxChunks  int
+
+	mutex   sync.Mutex
+	pending map[chunkKey]*partialPayload
+	order   []chunkKey
+}
+
+func NewReassembler(maxPending int) *Reassembler {
+	if maxPending <= 0 {
+		maxPending = 16
+	}
+	return &Reassembler{
+		maxPending: maxPending,
+		maxSize:    DefaultMaxSize,
+		maxChunks:  DefaultMaxChunks,
+		pending:    make(map[chunkKey]*partialPayload),
+	}
+}
+
+// SetLimits changes the largest payload and chunk count accepted, zero keeps
+// the default.
+func (r *Reassembler) SetLimits(maxSize, maxChunks int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if maxSize > 0 {
+		r.maxSize = maxSize
+	}
+	if maxChunks > 0 {
+		r.maxChunks = maxChunks
+	}
+}
+
+func (r *Reassembler) checkManifest(manifest *Manifest) error {
+	switch {
+	case manifest.Chunks <= 0 || manifest.Chunks > r.maxChunks:
+		return errors.Errorf("manifest for %s announces %d chunks, expected 1 to %d",
+			manifest.Fingerprint, manifest.Chunks, r.maxChunks)
+	case manifest.Size < 0 || manifest.Size > r.maxSize:
+		return errors.Errorf("manifest for %s announces %d bytes, expected 0 to %d",
+			manifest.Fingerprint, manifest.Size, r.maxSize)
+	case manifest.ChunkSize <= 0 || manifest.ChunkSize > r.maxSize:
+		return errors.Errorf("manifest for %s announces chunks of %d bytes", manifest.Fingerprint, manifest.ChunkSize)
+	case int64(manifest.Size) > int64(manifest.Chunks)*int64(manifest.ChunkSize):
+		return errors.Errorf("manifest for %s announces %d bytes in %d chunks of %d bytes",
+			manifest.Fingerprint, manifest.Size, manifest.Chunks, manifest.ChunkSize)
+	}
+	return nil
+}
+
+// Add feeds a message received from the channel. Messages that are not part
+// of a chunked payload are returned unchanged. For chunked payloads nil is
+// returned until the last piece arrives, then the reassembled payload.
+func (r *Reassembler) Add(message []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(message), []byte("{")) {
+		return message, nil
+	}
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(message, &header); err != nil {
+		return message, nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch header.Type {
+	case MessageTypeManifest:
+		var manifest Manifest
+		if err := json.Unmarshal(message, &manifest); err != nil {
+			return nil, errors.Wrap(err, "error decoding manifest")
+		}
+		if err := r.checkManifest(&manifest); err != nil {
+			return nil, err
+		}
+		key := chunkKey{manifest.Sequence, manifest.Fingerprint}
+		partial := r.partial(key)
+		partial.manifest = &manifest
+		for index, data := range partial.chunks {
+			if err := r.checkChunk(partial, index, data); err != nil {
+				r.forget(key)
+				return nil, err
+			}
+		}
+		if partial.size > manifest.Size {
+			r.forget(key)
+			return nil, errors.Errorf("chunks of %s exceed the announced %d bytes", manifest.Fingerprint, manifest.Size)
+		}
+		return r.complete(key)
+	case MessageTypeChunk:
+		var chunk Chunk
+		if err := json.Unmarshal(message, &chunk); err != nil {
+			return nil, errors.Wrap(err, "error decoding chunk")
+		}
+		key := chunkKey{chunk.Sequence, chunk.Fingerprint}
+		partial := r.partial(key)
+		if _, ok := partial.chunks[chunk.Index]; ok {
+			return nil, nil
+		}
+		if err := r.checkChunk(partial, chunk.Index, chunk.Data); err != nil {
+			r.forget(key)
+			return nil, err
+		}
+		maxSize := r.maxSize
+		if partial.manifest != nil {
+			maxSize = partial.manifest.Size
+		}
+		if partial.size+len(chunk.Data) > maxSize {
+			r.forget(key)
+			return nil, errors.Errorf("chunks of %s exceed %d bytes", chunk.Fingerprint, maxSize)
+		}
+		partial.chunks[chunk.Index] = chunk.Data
+		partial.size += len(chunk.Data)
+		return r.complete(key)
+	default:
+		return message, nil
+	}
+}
+
+// checkChunk rejects a chunk whose index or size does not fit the payload's
+// manifest, or the limits while the manifest has not arrived.
+func (r *Reassembler) checkChunk(partial *partialPayload, index int, data []byte) error {
+	maxChunks, maxChunkSize := r.maxChunks, r.maxSize
+	if manifest := partial.manifest; manifest != nil {
+		maxChunks, maxChunkSize = manifest.Chunks, manifest.ChunkSize
+	}
+	if index < 0 || index >= maxChunks {
+		return errors.Errorf("chunk index %d out of range, expected 0 to %d", index, maxChunks-1)
+	}
+	if len(data) > maxChunkSize {
+		return errors.Errorf("chunk %d has %d bytes, expected at most %d", index, len(data), maxChunkSize)
+	}
+	return nil
+}
+
+// Pending returns the number of incomplete payloads held.
+func (r *Reassembler) Pending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.pending)
+}
+
+func (r *Reassembler) partial(key chunkKey) *partialPayload {
+	if partial, ok := r.pending[key]; ok {
+		return partial
+	}
+	if len(r.order) >= r.maxPending {
+		delete(r.pending, r.order[0])
+		r.order = r.order[1:]
+	}
+	partial := &partialPayload{chunks: make(map[int][]byte)}
+	r.pending[key] = partial
+	r.order = append(r.order, key)
+	return partial
+}
+
+func (r *Reassembler) forget(key chunkKey) {
+	delete(r.pending, key)
+	for i, pending := range r.order {
+		if pending == key {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *Reassembler) complete(key chunkKey) ([]byte, error) {
+	partial := r.pending[key]
+	if partial.manifest == nil || len(partial.chunks) < partial.manifest.Chunks {
+		return nil, nil
+	}
+	r.forget(key)
+
+	manifest := partial.manifest
+	payload := make([]byte, 0, manifest.Size)
+	for i := 0; i < manifest.Chunks; i++ {
+		data, ok := partial.chunks[i]
+		if !ok {
+			return nil, errors.Errorf("payload %s is missing chunk %d of %d", manifest.Fingerprint, i, manifest.Chunks)
+		}
+		payload = append(payload, data...)
+	}
+	if len(payload) != manifest.Size || Checksum(payload) != manifest.Checksum {
+		return nil, errors.Errorf("payload %s failed its checksum", manifest.Fingerprint)
+	}
+	return payload, nil
+}
@@ -0,0 +1,139 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+func marshal(t *testing.T, message interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReassemblerOutOfOrder(t *testing.T) {
+	payload := make([]byte, 100_000)
+	rand.New(rand.NewSource(1)).Read(payload)
+	manifest, chunks := Split(payload, 7, "abc", 4096)
+	if manifest.Chunks != 25 || len(chunks) != 25 {
+		t.Fatalf("expected 25 chunks, got %d", manifest.Chunks)
+	}
+
+	r := NewReassembler(0)
+	// Chunks before the manifest, in reverse, with a duplicate
+	for i := len(chunks) - 1; i >= 1; i-- {
+		if out, err := r.Add(marshal(t, chunks[i])); out != nil || err != nil {
+			t.Fatalf("chunk %d completed early: %v", i, err)
+		}
+	}
+	r.Add(marshal(t, chunks[3]))
+	if out, err := r.Add(marshal(t, manifest)); out != nil || err != nil {
+		t.Fatalf("completed without chunk 0: %v", err)
+	}
+	out, err := r.Add(marshal(t, chunks[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("reassembled payload differs")
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("completed payload still pending")
+	}
+}
+
+func TestReassemblerChecksumAndPassThrough(t *testing.T) {
+	r := NewReassembler(0)
+	for _, message := range [][]byte{[]byte(`{"type":"template","sequence":1}`), {0x1f, 0x8b, 0x08}} {
+		if out, err := r.Add(message); err != nil || !bytes.Equal(out, message) {
+			t.Fatalf("message %q not passed through", message)
+		}
+	}
+
+	manifest, chunks := Split([]byte("hello world"), 1, "abc", 4)
+	chunks[1].Data = []byte("XXXX")
+	r.Add(marshal(t, manifest))
+	var err error
+	for _, chunk := range chunks {
+		_, err = r.Add(marshal(t, chunk))
+	}
+	if err == nil {
+		t.Fatalf("corrupted payload passed its checksum")
+	}
+}
+
+func TestReassemblerDropsOldest(t *testing.T) {
+	r := NewReassembler(2)
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		manifest, _ := Split([]byte("payload"), sequence, "abc", 2)
+		r.Add(marshal(t, manifest))
+	}
+	if r.Pending() != 2 {
+		t.Fatalf("expected 2 pending payloads, got %d", r.Pending())
+	}
+}
+
+func TestReassemblerRejectsBadManifests(t *testing.T) {
+	r := NewReassembler(0)
+	r.SetLimits(1000, 10)
+	for _, manifest := range []*Manifest{
+		{Chunks: 0, ChunkSize: 100, Size: 0},
+		{Chunks: 11, ChunkSize: 100, Size: 1000},
+		{Chunks: 2, ChunkSize: 100, Size: -1},
+		{Chunks: 2, ChunkSize: 100, Size: 201},
+		{Chunks: 10, ChunkSize: 1 << 40, Size: 1 << 50},
+		{Chunks: 10, ChunkSize: 0, Size: 10},
+	} {
+		manifest.Type, manifest.Fingerprint = MessageTypeManifest, "abc"
+		if _, err := r.Add(marshal(t, manifest)); err == nil {
+			t.Errorf("manifest %+v accepted", manifest)
+		}
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("rejected manifests were stored")
+	}
+
+	// Chunks beyond the limits are rejected before and after their manifest
+	manifest, chunks := Split(make([]byte, 100), 1, "abc", 40)
+	for _, chunk := range []*Chunk{
+		{Index: 10, Data: []byte("x")},
+		{Index: -1, Data: []byte("x")},
+		{Index: 0, Data: make([]byte, 1001)},
+	} {
+		chunk.Type, chunk.Sequence, chunk.Fingerprint = MessageTypeChunk, 2, "abc"
+		if _, err := r.Add(marshal(t, chunk)); err == nil {
+			t.Errorf("chunk %d of %d bytes accepted", chunk.Index, len(chunk.Data))
+		}
+	}
+	r.Add(marshal(t, manifest))
+	oversized := *chunks[0]
+	oversized.Data = make([]byte, 41)
+	if _, err := r.Add(marshal(t, &oversized)); err == nil {
+		t.Fatalf("chunk larger than the manifest's chunk size accepted")
+	}
+}
+
+func TestMaxChunkSizeFits(t *testing.T) {
+	for _, messageSize := range []int{200, 1000, 16384, 262144} {
+		chunkSize := MaxChunkSize(messageSize, 32)
+		if chunkSize <= 0 {
+			t.Fatalf("no chunk fits in %d bytes", messageSize)
+		}
+		if ChunkMessageSize(chunkSize, 32) > messageSize || ChunkMessageSize(chunkSize+3, 32) <= messageSize {
+			t.Fatalf("chunk size %d is not the largest fitting in %d bytes", chunkSize, messageSize)
+		}
+		chunk := &Chunk{Type: MessageTypeChunk, Sequence: 1 << 63, Fingerprint: "0123456789abcdef0123456789abcdef",
+			Index: 4095, Data: make([]byte, chunkSize)}
+		if size := len(marshal(t, chunk)); size > messageSize {
+			t.Fatalf("chunk message of %d bytes over %d", size, messageSize)
+		}
+	}
+	if MaxChunkSize(50, 32) > 0 {
+		t.Fatalf("chunk fits in a message smaller than the framing")
+	}
+}
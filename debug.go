@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// debugState is served on the admin port at /debug/state.
+var debugState = &statusRegistry{sections: make(map[string]func() interface{})}
+
+// startAdminServer serves pprof and the debug state dump. It listens on its
+// own address so it can stay bound to localhost while metrics are public.
+func startAdminServer(address string) {
+	mux := newAdminMux(debugState)
+	go func() {
+		log.Printf("serving admin endpoints on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Printf("admin server stopped: %v", err)
+		}
+	}()
+}
+
+func newAdminMux(state *statusRegistry) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/state", state)
+	state.Register("runtime", func() interface{} {
+		return map[string]interface{}{
+			"goroutines": runtime.NumGoroutine(),
+			"go_version": runtime.Version(),
+		}
+	})
+	return mux
+}
+
+// loopState records what a long running loop is currently doing.
+type loopState struct {
+	clock      clock
+	mutex      sync.Mutex
+	phase      string
+	since      time.Time
+	iterations uint64
+}
+
+func newLoopState(clk clock) *loopState {
+	return &loopState{clock: clk}
+}
+
+func (s *loopState) Set(phase string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if phase == s.phase {
+		return
+	}
+	s.phase = phase
+	s.since = s.clock.Now()
+}
+
+func (s *loopState) Iteration() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.iterations++
+}
+
+func (s *loopState) snapshot() interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return map[string]interface{}{
+		"phase":       s.phase,
+		"in_phase_ms": s.clock.Now().Sub(s.since).Milliseconds(),
+		"iterations":  s.iterations,
+	}
+}
+
+type recordedError struct {
+	At    int64  `json:"at"`
+	Error string `json:"error"`
+}
+
+// errorLog keeps the last errors reported by the fetcher.
+type errorLog struct {
+	clock   clock
+	mutex   sync.Mutex
+	size    int
+	entries []recordedError
+}
+
+func newErrorLog(size int, clk clock) *errorLog {
+	return &errorLog{clock: clk, size: size}
+}
+
+func (l *errorLog) Record(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, recordedError{At: l.clock.Now().UnixMilli(), Error: err.Error()})
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+}
+
+func (l *errorLog) snapshot() interface{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]recordedError{}, l.entries...)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestDebugState(t *testing.T) {
+	clk := newFakeClock()
+	fetcher, _ := newTestFetcher(clk, func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		return nil, errors.New("node down")
+	})
+	fetcher.fetchAndPublish(context.Background())
+	fetcher.state.Iteration()
+	clk.Advance(250 * time.Millisecond)
+
+	state := &statusRegistry{sections: make(map[string]func() interface{})}
+	fetcher.registerDebugState(state)
+	server := httptest.NewServer(newAdminMux(state))
+	defer server.Close()
+	response, err := http.Get(server.URL + "/debug/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %s with content type %s", response.Status, response.Header.Get("Content-Type"))
+	}
+
+	var document map[string]json.RawMessage
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	sections := make([]string, 0, len(document))
+	for name := range document {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+	if !reflect.DeepEqual(sections, []string{"fetch_loop", "node", "recent_errors", "runtime"}) {
+		t.Fatalf("unexpected sections %v", sections)
+	}
+
+	var loop map[string]interface{}
+	if err := json.Unmarshal(document["fetch_loop"], &loop); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loop, map[string]interface{}{"phase": "fetching", "in_phase_ms": 250.0, "iterations": 1.0}) {
+		t.Fatalf("unexpected fetch_loop section %v", loop)
+	}
+	var recent []recordedError
+	if err := json.Unmarshal(document["recent_errors"], &recent); err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 1 || recent[0].At != clk.Now().Add(-250*time.Millisecond).UnixMilli() {
+		t.Fatalf("unexpected recent_errors section %+v", recent)
+	}
+	var node healthSnapshot
+	if err := json.Unmarshal(document["node"], &node); err != nil {
+		t.Fatal(err)
+	}
+	if node.Healthy || node.ConsecutiveFailures != 1 || node.NodeFailures != 1 {
+		t.Fatalf("unexpected node section %+v", node)
+	}
+	var runtime struct {
+		Goroutines int    `json:"goroutines"`
+		GoVersion  string `json:"go_version"`
+	}
+	if err := json.Unmarshal(document["runtime"], &runtime); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Goroutines == 0 || runtime.GoVersion == "" {
+		t.Fatalf("unexpected runtime section %+v", runtime)
+	}
+}
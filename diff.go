@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type DiffConfig struct {
+	RedisChannel      string `json:"redis_channel"`
+	FullSnapshotEvery int    `json:"full_snapshot_every"`
+}
+
+const (
+	diffTypeSnapshot = "snapshot"
+	diffTypeDiff     = "diff"
+)
+
+type diffTransaction struct {
+	ID          string                     `json:"id"`
+	Transaction *appmessage.RPCTransaction `json:"transaction"`
+}
+
+// TemplateDiff is published on the diff channel. A diff only applies on top
+// of the template identified by PreviousFingerprint; consumers that do not
+// hold that template wait for the next snapshot. TransactionIDs always lists
+// the full transaction order of the new template.
+type TemplateDiff struct {
+	Type                string                                      `json:"type"`
+	Sequence            uint64                                      `json:"sequence"`
+	Fingerprint         string                                      `json:"fingerprint"`
+	PreviousFingerprint string                                      `json:"previous_fingerprint,omitempty"`
+	HeaderChanges       map[string]json.RawMessage                  `json:"header_changes,omitempty"`
+	Added               []*diffTransaction                          `json:"added,omitempty"`
+	Removed             []string                                    `json:"removed,omitempty"`
+	TransactionIDs      []string                                    `json:"transaction_ids"`
+	Template            *appmessage.GetBlockTemplateResponseMessage `json:"template,omitempty"`
+}
+
+// transactionIDs returns the IDs of the template's transactions in order.
+func transactionIDs(template *appmessage.GetBlockTemplateResponseMessage) ([]string, error) {
+	ids := make([]string, len(template.Block.Transactions))
+	for i, transaction := range template.Block.Transactions {
+		domainTransaction, err := appmessage.RPCTransactionToDomainTransaction(transaction)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid transaction %d", i)
+		}
+		ids[i] = consensushashing.TransactionID(domainTransaction).String()
+	}
+	return ids, nil
+}
+
+func headerFields(header *appmessage.RPCBlockHeader) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// headerChanges returns the header fields of current that differ from previous.
+func headerChanges(previous, current *appmessage.RPCBlockHeader) (map[string]json.RawMessage, error) {
+	previousFields, err := headerFields(previous)
+	if err != nil {
+		return nil, err
+	}
+	currentFields, err := headerFields(current)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(map[string]json.RawMessage)
+	for field, value := range currentFields {
+		if !bytes.Equal(previousFields[field], value) {
+			changes[field] = value
+		}
+	}
+	return changes, nil
+}
+
+// TemplateDiffer publishes the transaction-set and header changes between
+// consecutive templates, with a full snapshot every FullSnapshotEvery messages
+// so consumers can resync.
+type TemplateDiffer struct {
+	config DiffConfig
+	canary *DeliveryCanary
+	// send publishes one message, replaced in tests
+	send func(ctx context.Context, payload []byte) error
+
+	sequence        uint64
+	sinceSnapshot   int
+	previous        *appmessage.GetBlockTemplateResponseMessage
+	previousPrint   string
+	previousIDs     map[string]bool
+	previousIDOrder []string
+}
+
+func NewTemplateDiffer(rdb *redis.Client, config DiffConfig) *TemplateDiffer {
+	if config.FullSnapshotEvery == 0 {
+		config.FullSnapshotEvery = 20
+	}
+	return &TemplateDiffer{
+		config: config,
+		send: func(ctx context.Context, payload []byte) error {
+			return rdb.Publish(ctx, config.RedisChannel, payload).Err()
+		},
+	}
+}
+
+// SetCanary makes the differ announce every diff to the canary watching its
+// channel.
+func (d *TemplateDiffer) SetCanary(canary *DeliveryCanary) {
+	d.canary = canary
+}
+
+func (d *TemplateDiffer) build(envelope *TemplateEnvelope, template *appmessage.GetBlockTemplateResponseMessage,
+	ids []string) (*TemplateDiff, error) {
+
+	message := &TemplateDiff{
+		Sequence:       d.sequence + 1,
+		Fingerprint:    envelope.Fingerprint,
+		TransactionIDs: ids,
+	}
+	if d.previous == nil || d.sinceSnapshot >= d.config.FullSnapshotEvery {
+		message.Type = diffTypeSnapshot
+		message.Template = template
+		return message, nil
+	}
+
+	changes, err := headerChanges(d.previous.Block.Header, template.Block.Header)
+	if err != nil {
+		return nil, err
+	}
+	message.Type = diffTypeDiff
+	message.PreviousFingerprint = d.previousPrint
+	message.HeaderChanges = changes
+
+	current := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		current[id] = true
+		if !d.previousIDs[id] {
+			message.Added = append(message.Added, &diffTransaction{ID: id, Transaction: template.Block.Transactions[i]})
+		}
+	}
+	for _, id := range d.previousIDOrder {
+		if !current[id] {
+			message.Removed = append(message.Removed, id)
+		}
+	}
+	return message, nil
+}
+
+func (d *TemplateDiffer) Publish(ctx context.Context, envelope *TemplateEnvelope,
+	template *appmessage.GetBlockTemplateResponseMessage) error {
+
+	ids, err := transactionIDs(template)
+	if err != nil {
+		return errors.Wrap(err, "failed computing template diff")
+	}
+	message, err := d.build(envelope, template, ids)
+	if err != nil {
+		return errors.Wrap(err, "failed computing template diff")
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return errors.Wrap(err, "error serializing template diff to JSON")
+	}
+	if d.canary != nil {
+		d.canary.expect(message.Fingerprint, time.UnixMilli(envelope.FetchedAt))
+	}
+	if err := d.send(ctx, payload); err != nil {
+		if d.canary != nil {
+			d.canary.cancel(message.Fingerprint)
+		}
+		// Force a snapshot next time, consumers may have missed this diff
+		d.previous = nil
+		return errors.Wrap(err, "error publishing template diff to Redis")
+	}
+
+	d.sequence = message.Sequence
+	if message.Type == diffTypeSnapshot {
+		d.sinceSnapshot = 0
+	} else {
+		d.sinceSnapshot++
+	}
+	d.previous = template
+	d.previousPrint = envelope.Fingerprint
+	d.previousIDOrder = ids
+	d.previousIDs = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		d.previousIDs[id] = true
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type EventsConfig struct {
+	RedisStream  string `json:"redis_stream"`
+	StreamMaxLen int64  `json:"stream_max_len"`
+	// Node defaults to the first configured node
+	Node string `json:"node"`
+}
+
+const eventsQueueSize = 1024
+
+const (
+	eventBlockAdded                   = "block_added"
+	eventTipsChanged                  = "tips_changed"
+	eventVirtualSelectedParentChanged = "virtual_selected_parent_changed"
+	eventPruningPointChanged          = "pruning_point_changed"
+	eventPruningPointUTXOSetOverride  = "pruning_point_utxo_set_override"
+	eventVirtualDAAScoreChanged       = "virtual_daa_score_changed"
+)
+
+// dagEvent is one entry of the events stream, only the fields relevant to
+// the event type are set.
+type dagEvent struct {
+	Type         string   `json:"type"`
+	At           int64    `json:"at"`
+	Node         string   `json:"node"`
+	Hash         string   `json:"hash,omitempty"`
+	DAAScore     uint64   `json:"daa_score,omitempty"`
+	BlueScore    uint64   `json:"blue_score,omitempty"`
+	Parents      []string `json:"parents,omitempty"`
+	Tips         []string `json:"tips,omitempty"`
+	Added        []string `json:"added,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+	PruningPoint string   `json:"pruning_point,omitempty"`
+}
+
+// DAGEvents subscribes to a node's notifications and appends typed events to
+// a Redis stream. Tip and pruning point changes are not notified directly, so
+// the DAG info is re-read after every added block and UTXO set override.
+// Notification handlers only queue work, the node is queried and the stream
+// written from a separate goroutine; events are dropped when the queue is
+// full.
+type DAGEvents struct {
+	config EventsConfig
+	clock  clock
+	node   *KaspaApi
+	// dagInfo and xadd reach the node and Redis, replaced in tests
+	dagInfo func() (*appmessage.GetBlockDAGInfoResponseMessage, error)
+	xadd    func(ctx context.Context, args *redis.XAddArgs) error
+
+	events  chan *dagEvent
+	refresh chan struct{}
+
+	mutex        sync.Mutex
+	tips         string
+	pruningPoint string
+	published    map[string]uint64
+	dropped      uint64
+}
+
+func NewDAGEvents(rdb *redis.Client, config EventsConfig, clk clock) (*DAGEvents, error) {
+	node, err := NewKaspaAPI(config.Node, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to %s for notifications", config.Node)
+	}
+	e := newDAGEvents(config, clk, eventsQueueSize)
+	e.node = node
+	e.dagInfo = node.kaspad.GetBlockDAGInfo
+	e.xadd = func(ctx context.Context, args *redis.XAddArgs) error {
+		return rdb.XAdd(ctx, args).Err()
+	}
+	return e, nil
+}
+
+func newDAGEvents(config EventsConfig, clk clock, queueSize int) *DAGEvents {
+	if config.StreamMaxLen == 0 {
+		config.StreamMaxLen = 100000
+	}
+	return &DAGEvents{
+		config:    config,
+		clock:     clk,
+		events:    make(chan *dagEvent, queueSize),
+		refresh:   make(chan struct{}, 1),
+		published: make(map[string]uint64),
+	}
+}
+
+func (e *DAGEvents) Start(ctx context.Context) error {
+	kaspad := e.node.kaspad
+	if err := kaspad.RegisterForBlockAddedNotifications(e.onBlockAdded); err != nil {
+		return errors.Wrap(err, "error registering for block added notifications")
+	}
+	if err := kaspad.RegisterForVirtualSelectedParentChainChangedNotifications(false, e.onChainChanged); err != nil {
+		return errors.Wrap(err, "error registering for selected parent chain notifications")
+	}
+	if err := kaspad.RegisterPruningPointUTXOSetNotifications(e.onUTXOSetOverride); err != nil {
+		return errors.Wrap(err, "error registering for pruning point notifications")
+	}
+	if err := kaspad.RegisterForVirtualDaaScoreChangedNotifications(e.onDAAScoreChanged); err != nil {
+		return errors.Wrap(err, "error registering for virtual DAA score notifications")
+	}
+
+	metrics.Register(e.writeMetrics)
+	e.requestRefresh()
+	go e.run(ctx)
+	return nil
+}
+
+func (e *DAGEvents) onBlockAdded(notification *appmessage.BlockAddedNotificationMessage) {
+	e.emit(blockAddedEvent(notification.Block))
+	e.requestRefresh()
+}
+
+func (e *DAGEvents) onChainChanged(notification *appmessage.VirtualSelectedParentChainChangedNotificationMessage) {
+	if len(notification.AddedChainBlockHashes) == 0 {
+		return
+	}
+	added := notification.AddedChainBlockHashes
+	e.emit(&dagEvent{
+		Type:    eventVirtualSelectedParentChanged,
+		Hash:    added[len(added)-1],
+		Added:   added,
+		Removed: notification.RemovedChainBlockHashes,
+	})
+}
+
+func (e *DAGEvents) onUTXOSetOverride() {
+	e.emit(&dagEvent{Type: eventPruningPointUTXOSetOverride})
+	e.requestRefresh()
+}
+
+func (e *DAGEvents) onDAAScoreChanged(notification *appmessage.VirtualDaaScoreChangedNotificationMessage) {
+	e.emit(&dagEvent{Type: eventVirtualDAAScoreChanged, DAAScore: notification.VirtualDaaScore})
+}
+
+func blockAddedEvent(block *appmessage.RPCBlock) *dagEvent {
+	event := &dagEvent{Type: eventBlockAdded}
+	if block == nil || block.Header == nil {
+		return event
+	}
+	event.DAAScore = block.Header.DAAScore
+	event.BlueScore = block.Header.BlueScore
+	if len(block.Header.Parents) > 0 {
+		event.Parents = block.Header.Parents[0].ParentHashes
+	}
+	if block.VerboseData != nil {
+		event.Hash = block.VerboseData.Hash
+	}
+	return event
+}
+
+func (e *DAGEvents) emit(event *dagEvent) {
+	event.At = e.clock.Now().UnixMilli()
+	event.Node = e.config.Node
+	select {
+	case e.events <- event:
+	default:
+		e.mutex.Lock()
+		e.dropped++
+		e.mutex.Unlock()
+	}
+}
+
+func (e *DAGEvents) requestRefresh() {
+	select {
+	case e.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// QueueDepth returns the number of events waiting to be written.
+func (e *DAGEvents) QueueDepth() int {
+	return len(e.events)
+}
+
+func (e *DAGEvents) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.refresh:
+			if err := e.refreshDAG(); err != nil {
+				log.Printf("events: %v", err)
+			}
+		case event := <-e.events:
+			if err := e.write(ctx, event); err != nil {
+				log.Printf("events: %v", err)
+			}
+		}
+	}
+}
+
+// refreshDAG emits tip and pruning point changes since the last refresh.
+func (e *DAGEvents) refreshDAG() error {
+	info, err := e.dagInfo()
+	if err != nil {
+		return errors.Wrap(err, "error fetching DAG info")
+	}
+	tips := append([]string{}, info.TipHashes...)
+	sort.Strings(tips)
+	tipsKey := strings.Join(tips, ",")
+
+	e.mutex.Lock()
+	tipsChanged := tipsKey != e.tips
+	pruningPointChanged := info.PruningPointHash != e.pruningPoint
+	e.tips, e.pruningPoint = tipsKey, info.PruningPointHash
+	e.mutex.Unlock()
+
+	if tipsChanged {
+		e.emit(&dagEvent{Type: eventTipsChanged, Tips: tips, DAAScore: info.VirtualDAAScore})
+	}
+	if pruningPointChanged {
+		e.emit(&dagEvent{Type: eventPruningPointChanged, PruningPoint: info.PruningPointHash})
+	}
+	return nil
+}
+
+func (e *DAGEvents) write(ctx context.Context, event *dagEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "error serializing event")
+	}
+	err = e.xadd(ctx, &redis.XAddArgs{
+		Stream: e.config.RedisStream,
+		MaxLen: e.config.StreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"type": event.Type, "event": data},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed adding to events stream")
+	}
+	e.mutex.Lock()
+	e.published[event.Type]++
+	e.mutex.Unlock()
+	return nil
+}
+
+func (e *DAGEvents) writeMetrics(w io.Writer) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	types := make([]string, 0, len(e.published))
+	for eventType := range e.published {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	for _, eventType := range types {
+		fmt.Fprintf(w, "katpool_dag_events_total{type=%q} %d\n", eventType, e.published[eventType])
+	}
+	fmt.Fprintf(w, "katpool_dag_events_dropped_total %d\n", e.dropped)
+	fmt.Fprintf(w, "katpool_dag_events_queue_depth %d\n", len(e.events))
+}
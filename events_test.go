@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"golang.org/x/net/context"
+)
+
+// newTestDAGEvents returns DAG events that report info from the given DAG
+// states in turn and collect stream entries instead of writing to Redis.
+func newTestDAGEvents(queueSize int, states []*appmessage.GetBlockDAGInfoResponseMessage) (*DAGEvents, *[]*redis.XAddArgs) {
+	e := newDAGEvents(EventsConfig{RedisStream: "events", Node: "node"}, newFakeClock(), queueSize)
+	e.dagInfo = func() (*appmessage.GetBlockDAGInfoResponseMessage, error) {
+		state := states[0]
+		if len(states) > 1 {
+			states = states[1:]
+		}
+		return state, nil
+	}
+	var entries []*redis.XAddArgs
+	e.xadd = func(ctx context.Context, args *redis.XAddArgs) error {
+		entries = append(entries, args)
+		return nil
+	}
+	return e, &entries
+}
+
+// drain writes every queued event, running queued DAG refreshes first like
+// the run loop would.
+func drain(t *testing.T, e *DAGEvents) {
+	t.Helper()
+	for {
+		select {
+		case <-e.refresh:
+			if err := e.refreshDAG(); err != nil {
+				t.Fatal(err)
+			}
+		case event := <-e.events:
+			if err := e.write(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestDAGEventsStreamEntries(t *testing.T) {
+	e, entries := newTestDAGEvents(16, []*appmessage.GetBlockDAGInfoResponseMessage{
+		{TipHashes: []string{"b", "a"}, PruningPointHash: "p1", VirtualDAAScore: 10},
+		{TipHashes: []string{"a", "b"}, PruningPointHash: "p1", VirtualDAAScore: 11},
+		{TipHashes: []string{"c"}, PruningPointHash: "p2", VirtualDAAScore: 12},
+	})
+
+	e.onBlockAdded(&appmessage.BlockAddedNotificationMessage{Block: &appmessage.RPCBlock{
+		Header:      &appmessage.RPCBlockHeader{DAAScore: 10, BlueScore: 9, Parents: []*appmessage.RPCBlockLevelParents{{ParentHashes: []string{"a"}}}},
+		VerboseData: &appmessage.RPCBlockVerboseData{Hash: "b"},
+	}})
+	drain(t, e)
+	e.onChainChanged(&appmessage.VirtualSelectedParentChainChangedNotificationMessage{
+		AddedChainBlockHashes: []string{"a", "b"}, RemovedChainBlockHashes: []string{"x"}})
+	e.onChainChanged(&appmessage.VirtualSelectedParentChainChangedNotificationMessage{})
+	e.onDAAScoreChanged(&appmessage.VirtualDaaScoreChangedNotificationMessage{VirtualDaaScore: 11})
+	// The same tips in another order are no change
+	e.requestRefresh()
+	drain(t, e)
+	e.onUTXOSetOverride()
+	drain(t, e)
+
+	var types []string
+	var events []dagEvent
+	for _, entry := range *entries {
+		if entry.Stream != "events" || entry.MaxLen != 100000 || !entry.Approx {
+			t.Fatalf("unexpected stream arguments %+v", entry)
+		}
+		var event dagEvent
+		if err := json.Unmarshal(entry.Values.(map[string]interface{})["event"].([]byte), &event); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Values.(map[string]interface{})["type"] != event.Type || event.Node != "node" {
+			t.Fatalf("entry type %v does not match event %+v", entry.Values, event)
+		}
+		types = append(types, event.Type)
+		events = append(events, event)
+	}
+	expected := []string{
+		eventBlockAdded, eventTipsChanged, eventPruningPointChanged,
+		eventVirtualSelectedParentChanged, eventVirtualDAAScoreChanged,
+		eventPruningPointUTXOSetOverride, eventTipsChanged, eventPruningPointChanged,
+	}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected events\n got %v\nwant %v", types, expected)
+	}
+	if events[0].Hash != "b" || events[0].DAAScore != 10 || events[0].Parents[0] != "a" {
+		t.Fatalf("unexpected block added event %+v", events[0])
+	}
+	if strings.Join(events[1].Tips, ",") != "a,b" || events[2].PruningPoint != "p1" {
+		t.Fatalf("unexpected DAG change events %+v %+v", events[1], events[2])
+	}
+	if events[3].Hash != "b" || events[3].Removed[0] != "x" || events[7].PruningPoint != "p2" {
+		t.Fatalf("unexpected events %+v %+v", events[3], events[7])
+	}
+}
+
+func TestDAGEventsDropWhenQueueFull(t *testing.T) {
+	e, entries := newTestDAGEvents(2, []*appmessage.GetBlockDAGInfoResponseMessage{{}})
+	for score := uint64(1); score <= 5; score++ {
+		e.onDAAScoreChanged(&appmessage.VirtualDaaScoreChangedNotificationMessage{VirtualDaaScore: score})
+	}
+	if e.QueueDepth() != 2 || e.dropped != 3 {
+		t.Fatalf("expected 2 queued and 3 dropped events, got %d and %d", e.QueueDepth(), e.dropped)
+	}
+	drain(t, e)
+	if len(*entries) != 2 {
+		t.Fatalf("expected the 2 queued events in the stream, got %d", len(*entries))
+	}
+
+	var metrics strings.Builder
+	e.writeMetrics(&metrics)
+	for _, line := range []string{
+		`katpool_dag_events_total{type="virtual_daa_score_changed"} 2`,
+		"katpool_dag_events_dropped_total 3",
+		"katpool_dag_events_queue_depth 0",
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Fatalf("metrics missing %q:\n%s", line, metrics.String())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+var exportColumns = []string{
+	"fingerprint", "sequence", "node", "fetched_at", "published_at", "daa_score", "blue_score", "bits",
+	"timestamp", "tx_count", "coinbase_value", "merged_fees", "fees", "fetch_latency_ms", "publish_latency_ms",
+}
+
+type exportFilter struct {
+	from, to       time.Time
+	node           string
+	minDAA, maxDAA uint64
+}
+
+func (f *exportFilter) match(record *historyRecord) bool {
+	published := time.UnixMilli(record.PublishedAt)
+	if published.Before(f.from) || published.After(f.to) {
+		return false
+	}
+	if f.node != "" && record.Node != f.node {
+		return false
+	}
+	if record.DAAScore < f.minDAA || (f.maxDAA != 0 && record.DAAScore > f.maxDAA) {
+		return false
+	}
+	return true
+}
+
+// recordColumns flattens a record into the selected columns, going through
+// its JSON form so column names always match the NDJSON field names.
+func recordColumns(record *historyRecord, columns []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(columns))
+	for _, column := range columns {
+		selected[column] = fields[column]
+	}
+	return selected, nil
+}
+
+type recordWriter interface {
+	Write(record *historyRecord) error
+	Flush() error
+}
+
+type csvRecordWriter struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func (w *csvRecordWriter) Write(record *historyRecord) error {
+	fields, err := recordColumns(record, w.columns)
+	if err != nil {
+		return err
+	}
+	row := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		row[i] = string(fields[column])
+		// String fields are decoded so JSON escapes don't end up in the CSV
+		if strings.HasPrefix(row[i], `"`) {
+			if err := json.Unmarshal(fields[column], &row[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return w.writer.Write(row)
+}
+
+func (w *csvRecordWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type ndjsonRecordWriter struct {
+	encoder *json.Encoder
+	columns []string
+}
+
+func (w *ndjsonRecordWriter) Write(record *historyRecord) error {
+	fields, err := recordColumns(record, w.columns)
+	if err != nil {
+		return err
+	}
+	return w.encoder.Encode(fields)
+}
+
+func (w *ndjsonRecordWriter) Flush() error {
+	return nil
+}
+
+func parseExportTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// runExport implements the export command, dumping recorded template history
+// from the archive, a disk recording or the history stream as CSV or NDJSON.
+func runExport(config *BridgeConfig, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	source := flags.String("source", "", "archive, recording or stream (defaults to the first one configured)")
+	format := flags.String("format", "csv", "csv or ndjson")
+	columnList := flags.String("columns", strings.Join(exportColumns, ","), "comma separated columns to emit")
+	since := flags.Duration("since", 24*time.Hour, "export records newer than this, ignored when -from is set")
+	fromValue := flags.String("from", "", "start of the time range (RFC3339)")
+	toValue := flags.String("to", "", "end of the time range (RFC3339)")
+	node := flags.String("node", "", "only export templates fetched from this node")
+	minDAA := flags.Uint64("min-daa", 0, "only export templates with at least this DAA score")
+	maxDAA := flags.Uint64("max-daa", 0, "only export templates with at most this DAA score")
+	output := flags.String("o", "", "output file (defaults to stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	filter := &exportFilter{node: *node, minDAA: *minDAA, maxDAA: *maxDAA}
+	var err error
+	if filter.from, err = parseExportTime(*fromValue, now.Add(-*since)); err != nil {
+		return errors.Wrap(err, "invalid -from")
+	}
+	if filter.to, err = parseExportTime(*toValue, now); err != nil {
+		return errors.Wrap(err, "invalid -to")
+	}
+
+	columns := strings.Split(*columnList, ",")
+	for _, column := range columns {
+		if !containsString(exportColumns, column) {
+			return errors.Errorf("unknown column %q, expected some of %s", column, strings.Join(exportColumns, ","))
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	var writer recordWriter
+	switch *format {
+	case "csv":
+		csvWriter := csv.NewWriter(out)
+		if err := csvWriter.Write(columns); err != nil {
+			return err
+		}
+		writer = &csvRecordWriter{writer: csvWriter, columns: columns}
+	case "ndjson":
+		writer = &ndjsonRecordWriter{encoder: json.NewEncoder(out), columns: columns}
+	default:
+		return errors.Errorf("unknown format %q", *format)
+	}
+
+	if *source == "" {
+		switch {
+		case config.Archive.Path != "":
+			*source = "archive"
+		case config.History.RecordPath != "":
+			*source = "recording"
+		case config.History.RedisStream != "":
+			*source = "stream"
+		default:
+			return errors.New("no template history configured")
+		}
+	}
+
+	count := 0
+	emit := func(record *historyRecord) error {
+		if !filter.match(record) {
+			return nil
+		}
+		count++
+		return writer.Write(record)
+	}
+
+	switch *source {
+	case "archive":
+		var db *sql.DB
+		if db, err = openArchiveReadOnly(config.Archive.Path); err != nil {
+			return err
+		}
+		defer db.Close()
+		err = readArchive(db, filter.from, filter.to, emit)
+	case "recording":
+		err = readRecording(config.History.RecordPath, emit)
+	case "stream":
+		rdb := redis.NewClient(&redis.Options{Addr: config.RedisAddress})
+		defer rdb.Close()
+		err = readHistoryStream(context.Background(), rdb, config.History.RedisStream, filter.from, filter.to, emit)
+	default:
+		return errors.Errorf("unknown source %q", *source)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records from %s\n", count, *source)
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
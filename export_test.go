@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExportArchiveReadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.db")
+	db, err := openArchiveDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A DAA score that doesn't scan into the record makes the read fail
+	_, err = db.Exec(`INSERT INTO templates VALUES ('abc', 1, ?, ?, 'node', 'not a number', 0, 0, 0, 0, 0, 0, 0, 0, 0)`,
+		time.Now().UnixMilli(), time.Now().UnixMilli())
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &BridgeConfig{Archive: ArchiveConfig{Path: path}}
+	err = runExport(config, []string{"-source", "archive", "-o", filepath.Join(t.TempDir(), "out.csv")})
+	if err == nil {
+		t.Fatal("expected the archive read error to be returned")
+	}
+}
+
+func TestExportCSVDecodesStrings(t *testing.T) {
+	var out bytes.Buffer
+	writer := &csvRecordWriter{writer: csv.NewWriter(&out), columns: []string{"node", "fingerprint", "daa_score"}}
+	record := &historyRecord{Node: `node "é"`, Fingerprint: "<abc>"}
+	record.DAAScore = 42
+	if err := writer.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != record.Node || rows[0][1] != record.Fingerprint || rows[0][2] != "42" {
+		t.Fatalf("unexpected CSV row %q", rows)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// templateFetcher fetches templates from the node pool and hands them to
+// every configured sink. Fetches come from the polling loop and from
+// on-demand requests, so they are serialized to keep sequence numbers and
+// diffs consistent.
+type templateFetcher struct {
+	clock   clock
+	config  *BridgeConfig
+	rdb     *redis.Client
+	address string
+
+	pool      *nodePool
+	selector  *templateSelector
+	publisher *TemplatePublisher
+	channels  []*TemplatePublisher
+	cache     *templateCache
+	scheduler *pollScheduler
+	health    *fetcherHealth
+	notifier  *systemdNotifier
+	state     *loopState
+	errors    *errorLog
+
+	// Optional sinks, nil unless configured
+	registry  *InstanceRegistry
+	assembler *blockAssembler
+	differ    *TemplateDiffer
+	archive   *TemplateArchive
+	history   *TemplateHistory
+	store     templateStore
+
+	mutex sync.Mutex
+}
+
+func (f *templateFetcher) reportError(err error) {
+	log.Printf("%v", err)
+	f.errors.Record(err)
+}
+
+// registerDebugState exposes the loop's phase, its recent errors and the
+// node's health in the debug state dump.
+func (f *templateFetcher) registerDebugState(state *statusRegistry) {
+	state.Register("fetch_loop", f.state.snapshot)
+	state.Register("recent_errors", f.errors.snapshot)
+	state.Register("node", func() interface{} { return f.health.Snapshot() })
+}
+
+// run fetches and publishes templates until ctx is done, waiting between
+// fetches as long as the scheduler asks.
+func (f *templateFetcher) run(ctx context.Context) {
+	for {
+		f.fetchAndPublish(ctx)
+		f.notifier.Alive()
+		f.state.Iteration()
+		f.state.Set("sleeping")
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.scheduler.Wait():
+		}
+	}
+}
+
+// fetchAndPublish fetches a template, hands it to every configured sink and
+// records the outcome, whether the polling loop or a request asked for it.
+func (f *templateFetcher) fetchAndPublish(ctx context.Context) (*TemplateEnvelope, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	envelope, err := f.publish(ctx)
+	now := f.clock.Now()
+	if err != nil {
+		f.reportError(err)
+		f.scheduler.Failure()
+		f.health.Failure(err, now)
+		f.notifier.Failure(err)
+		return nil, err
+	}
+	f.scheduler.Success(envelope.Template.Block.Header.DAAScore, now)
+	f.health.Success(envelope.Template.IsSynced, now)
+	f.notifier.Success(envelope)
+	return envelope, nil
+}
+
+func (f *templateFetcher) publish(ctx context.Context) (*TemplateEnvelope, error) {
+	if f.registry != nil && f.config.Registry.RefuseOnConflict {
+		if err := f.registry.Conflict(); err != nil {
+			return nil, err
+		}
+	}
+
+	f.state.Set("fetching")
+	fetchedAt := f.clock.Now()
+	result, selection, err := f.selector.Select(f.pool.Fetch(f.address))
+	if err != nil {
+		f.health.NodeFailure(err)
+		return nil, err
+	}
+	f.health.NodeSuccess()
+	template, fetchLatency := result.template, result.latency
+
+	var assembly *assemblyReport
+	if f.assembler != nil {
+		f.state.Set("assembling")
+		assembled, report, err := f.assembler.Assemble(template)
+		switch {
+		case err != nil && !f.config.Assembly.FallbackToOriginal:
+			return nil, err
+		case err != nil:
+			f.reportError(errors.Wrap(err, "publishing the node's template"))
+		default:
+			template, assembly = assembled, report
+		}
+	}
+
+	// Serialize and publish the template to Redis
+	f.state.Set("publishing")
+	envelope, err := f.publisher.Publish(ctx, template, fetchedAt, selection, assembly)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.Set(envelope)
+	log.Printf("template published to Redis channel %s", f.config.RedisChannel)
+
+	f.state.Set("updating sinks")
+	if assembly != nil {
+		if err := f.assembler.Audit(ctx, envelope.Fingerprint, result.template); err != nil {
+			f.reportError(err)
+		}
+	}
+	for _, channel := range f.channels {
+		if _, err := channel.Publish(ctx, template, fetchedAt, selection, assembly); err != nil {
+			f.reportError(errors.Wrapf(err, "error publishing to %s", channel.channel))
+		}
+	}
+	if f.config.HeaderHashKey != "" {
+		if err := writeHeaderHash(ctx, f.rdb, f.config.HeaderHashKey, envelope, template); err != nil {
+			f.reportError(err)
+		}
+	}
+	if f.config.Staleness.RedisKey != "" {
+		if err := writeExpiry(ctx, f.rdb, f.config.Staleness.RedisKey, envelope); err != nil {
+			f.reportError(err)
+		}
+	}
+	if f.differ != nil {
+		if err := f.differ.Publish(ctx, envelope, template); err != nil {
+			f.reportError(err)
+		}
+	}
+	record := newHistoryRecord(result.node, envelope, template, fetchLatency)
+	if f.archive != nil || f.history != nil {
+		record.Fees = result.fees
+		if !f.pool.fees || assembly != nil {
+			// Not fetched for the selection, or the assembler dropped
+			// transactions since
+			if record.Fees, err = f.pool.Fees(result.node, template); err != nil {
+				f.reportError(errors.Wrap(err, "error looking up template fees"))
+			}
+		}
+	}
+	if f.archive != nil {
+		f.archive.Record(record)
+	}
+	if f.history != nil {
+		if err := f.history.Record(ctx, record); err != nil {
+			f.reportError(err)
+		}
+	}
+	if f.store != nil {
+		if err := f.store.Save(ctx, envelope); err != nil {
+			f.reportError(errors.Wrap(err, "error persisting template"))
+		}
+	}
+	return envelope, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// newTestFetcher returns a fetcher polling a single node every second, with
+// every published message delivered to the returned channel.
+func newTestFetcher(clk *fakeClock, fetch func(string) (*appmessage.GetBlockTemplateResponseMessage, error)) (
+	*templateFetcher, chan *TemplateEnvelope) {
+
+	published := make(chan *TemplateEnvelope, 16)
+	publisher := NewTemplatePublisher(nil, "templates", true, clk)
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		var envelope TemplateEnvelope
+		if err := json.Unmarshal(messages[0], &envelope); err != nil {
+			return 0, err
+		}
+		published <- &envelope
+		return 1, nil
+	}
+	fetcher := &templateFetcher{
+		clock:     clk,
+		config:    &BridgeConfig{RedisChannel: "templates"},
+		pool:      &nodePool{clock: clk, timeout: time.Hour, nodes: []*poolNode{{address: "node", fetch: fetch}}},
+		selector:  newTemplateSelector(SelectionConfig{}, []string{"node"}, clk),
+		publisher: publisher,
+		cache:     &templateCache{},
+		scheduler: newPollScheduler(time.Second, PollingConfig{}, clk),
+		health:    newFetcherHealth(clk),
+		notifier:  &systemdNotifier{},
+		state:     newLoopState(clk),
+		errors:    newErrorLog(10, clk),
+	}
+	return fetcher, published
+}
+
+func TestTemplateFetcherLoop(t *testing.T) {
+	clk := newFakeClock()
+	generator := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1})
+	var calls int32
+	fetcher, published := newTestFetcher(clk, func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		if atomic.AddInt32(&calls, 1) == 3 {
+			return nil, errors.New("node down")
+		}
+		return generator.next(), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		fetcher.run(ctx)
+		close(stopped)
+	}()
+
+	start := clk.Now()
+	first := <-published
+	if first.Sequence != 1 || first.FetchedAt != start.UnixMilli() || first.PublishedAt != start.UnixMilli() {
+		t.Fatalf("unexpected first envelope %+v", first)
+	}
+
+	clk.waitForTimer(time.Second)
+	clk.Advance(time.Second)
+	second := <-published
+	if second.Sequence != 2 || second.FetchedAt != start.Add(time.Second).UnixMilli() {
+		t.Fatalf("expected the second fetch a second later, got sequence %d fetched at %d",
+			second.Sequence, second.FetchedAt)
+	}
+	if cached, _ := fetcher.cache.Get(); templateFingerprint(cached) != second.Fingerprint {
+		t.Fatalf("cache does not hold the last published template")
+	}
+
+	// The third fetch fails and the loop keeps polling
+	clk.waitForTimer(time.Second)
+	clk.Advance(time.Second)
+	clk.waitForTimer(time.Second)
+	if health := fetcher.health.Snapshot(); health.ConsecutiveFailures != 1 || health.LastError == "" {
+		t.Fatalf("expected the failed fetch in the health state, got %+v", health)
+	}
+	clk.Advance(time.Second)
+	if fourth := <-published; fourth.Sequence != 3 || fourth.FetchedAt != start.Add(3*time.Second).UnixMilli() {
+		t.Fatalf("expected the loop to recover, got sequence %d fetched at %d", fourth.Sequence, fourth.FetchedAt)
+	}
+
+	cancel()
+	<-stopped
+}
+
+func TestNodesDownOnlyCountsNodeFailures(t *testing.T) {
+	clk := newFakeClock()
+	generator := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1})
+	var nodeDown int32
+	fetcher, _ := newTestFetcher(clk, func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		if atomic.LoadInt32(&nodeDown) != 0 {
+			return nil, errors.New("connection refused")
+		}
+		return generator.next(), nil
+	})
+	fetcher.publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		return 0, errors.New("redis unavailable")
+	}
+	nodesDown := nodesDownRule(fetcher.health, 3)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := fetcher.fetchAndPublish(ctx); err == nil {
+			t.Fatal("expected the publish to fail")
+		}
+	}
+	if firing, _ := nodesDown(ctx, clk.Now()); firing {
+		t.Fatal("nodes_down fired on publish failures")
+	}
+	if health := fetcher.health.Snapshot(); health.ConsecutiveFailures != 5 || health.NodeFailures != 0 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+
+	atomic.StoreInt32(&nodeDown, 1)
+	for i := 0; i < 3; i++ {
+		fetcher.fetchAndPublish(ctx)
+	}
+	firing, message := nodesDown(ctx, clk.Now())
+	if !firing || !strings.Contains(message, "connection refused") {
+		t.Fatalf("expected nodes_down to fire with the node error, got %v %q", firing, message)
+	}
+
+	// A node answering resets the count even if publishing still fails
+	atomic.StoreInt32(&nodeDown, 0)
+	fetcher.fetchAndPublish(ctx)
+	if firing, _ := nodesDown(ctx, clk.Now()); firing {
+		t.Fatal("nodes_down still firing after a node answered")
+	}
+}
+
+func TestWatchdogDuringNodeOutage(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	clk := newFakeClock()
+	fetcher, _ := newTestFetcher(clk, func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		return nil, errors.New("node down")
+	})
+	fetcher.notifier = &systemdNotifier{socket: socket, watchdog: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fetcher.run(ctx)
+
+	read := func() string {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 1024)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buffer[:n])
+	}
+	for i := 0; i < 2; i++ {
+		if status := read(); !strings.HasPrefix(status, "STATUS=fetch loop failing") || !strings.Contains(status, "node down") {
+			t.Fatalf("expected the node failure in the status, got %q", status)
+		}
+		if ping := read(); ping != "WATCHDOG=1" {
+			t.Fatalf("expected a watchdog ping after a failed fetch, got %q", ping)
+		}
+		clk.waitForTimer(time.Minute)
+		clk.Advance(time.Minute)
+	}
+}
+
+func TestFetcherRecordsTemplateFees(t *testing.T) {
+	clk := newFakeClock()
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	ids, err := transactionIDs(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher, _ := newTestFetcher(clk, func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		return template, nil
+	})
+	// Every transaction but the coinbase pays a fee of 10
+	fetcher.pool.nodes[0].mempool = func() (*appmessage.GetMempoolEntriesResponseMessage, error) {
+		entries := make([]*appmessage.MempoolEntry, 0, len(ids)-1)
+		for _, id := range ids[1:] {
+			entries = append(entries, &appmessage.MempoolEntry{Fee: 10,
+				Transaction: &appmessage.RPCTransaction{VerboseData: &appmessage.RPCTransactionVerboseData{TransactionID: id}}})
+		}
+		return appmessage.NewGetMempoolEntriesResponseMessage(entries), nil
+	}
+	path := filepath.Join(t.TempDir(), "history.ndjson")
+	if fetcher.history, err = NewTemplateHistory(HistoryConfig{RecordPath: path}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fetcher.fetchAndPublish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var fees []uint64
+	err = readRecording(path, func(record *historyRecord) error {
+		fees = append(fees, record.Fees)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fees) != 1 || fees[0] != uint64(10*(len(ids)-1)) {
+		t.Fatalf("expected the template's fees to be recorded, got %v", fees)
+	}
+}
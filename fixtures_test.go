@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Templates captured from a node with the capture command live in
+// testdata/templates, named <network>-<label>-<daa score>.json, and tests over
+// them are skipped while none are checked in. Synthetic templates made with
+// the loadgen generator live in testdata/synthetic and only stand in where a
+// test needs a particular shape of template.
+const (
+	capturedDir  = "testdata/templates"
+	syntheticDir = "testdata/synthetic"
+)
+
+func loadTemplateFile(t testing.TB, path string) *appmessage.GetBlockTemplateResponseMessage {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed reading template %s: %v", path, err)
+	}
+	var template appmessage.GetBlockTemplateResponseMessage
+	if err := json.Unmarshal(data, &template); err != nil {
+		t.Fatalf("failed decoding template %s: %v", path, err)
+	}
+	return &template
+}
+
+func loadSyntheticTemplate(t testing.TB, name string) *appmessage.GetBlockTemplateResponseMessage {
+	t.Helper()
+	return loadTemplateFile(t, filepath.Join(syntheticDir, name))
+}
+
+// capturedTemplates loads every captured template keyed by file name, and
+// skips the test when there are none.
+func capturedTemplates(t testing.TB) map[string]*appmessage.GetBlockTemplateResponseMessage {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(capturedDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skipf("no captured templates in %s", capturedDir)
+	}
+	templates := make(map[string]*appmessage.GetBlockTemplateResponseMessage, len(paths))
+	for _, path := range paths {
+		templates[filepath.Base(path)] = loadTemplateFile(t, path)
+	}
+	return templates
+}
+
+func TestCapturedTemplatesRoundTrip(t *testing.T) {
+	for name, template := range capturedTemplates(t) {
+		data, err := json.Marshal(template)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var decoded appmessage.GetBlockTemplateResponseMessage
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(template, &decoded) {
+			t.Fatalf("%s: template changed across a JSON round trip", name)
+		}
+		if templateFingerprint(template) != templateFingerprint(&decoded) {
+			t.Fatalf("%s: fingerprint changed across a JSON round trip", name)
+		}
+	}
+}
+
+func TestCapturedTemplatesConvertToDomainBlocks(t *testing.T) {
+	for name, template := range capturedTemplates(t) {
+		block, err := appmessage.RPCBlockToDomainBlock(template.Block)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(block.Transactions) != len(template.Block.Transactions) {
+			t.Fatalf("%s: converted block has %d transactions, expected %d",
+				name, len(block.Transactions), len(template.Block.Transactions))
+		}
+		if _, err := transactionIDs(template); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if strings.Contains(name, "many-parents") && len(block.Header.Parents()) < 2 {
+			t.Fatalf("%s: expected several parent levels", name)
+		}
+	}
+}
+
+// TestCapturedTemplatesCoverLabels checks every network with captures has the
+// full set, each holding the shape its label promises.
+func TestCapturedTemplatesCoverLabels(t *testing.T) {
+	labels := make(map[string]map[string]bool)
+	for name, template := range capturedTemplates(t) {
+		network := capturedNetwork(t, name)
+		label := strings.TrimPrefix(name, network+"-")
+		label = label[:strings.LastIndex(label, "-")]
+		if err := checkCaptureLabel(label, template); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if labels[network] == nil {
+			labels[network] = make(map[string]bool)
+		}
+		labels[network][label] = true
+	}
+	for network, captured := range labels {
+		for _, label := range captureLabels {
+			if !captured[label] {
+				t.Errorf("no %s capture for %s", label, network)
+			}
+		}
+	}
+}
+
+func TestCheckCaptureLabel(t *testing.T) {
+	empty := loadSyntheticTemplate(t, "empty.json")
+	if err := checkCaptureLabel("empty", empty); err != nil {
+		t.Fatal(err)
+	}
+	for _, label := range []string{"many-txs", "many-parents"} {
+		if err := checkCaptureLabel(label, empty); err == nil {
+			t.Errorf("empty template accepted as %s", label)
+		}
+	}
+	for _, label := range []string{"many-txs", "many-parents"} {
+		if err := checkCaptureLabel(label, loadSyntheticTemplate(t, label+".json")); err != nil {
+			t.Fatalf("%s: %v", label, err)
+		}
+	}
+}
+
+func TestSyntheticTemplateSummary(t *testing.T) {
+	empty := summarizeTemplate(loadSyntheticTemplate(t, "empty.json"))
+	if empty.TxCount != 0 || empty.CoinbaseValue == 0 {
+		t.Fatalf("unexpected summary of an empty template: %+v", empty)
+	}
+	full := summarizeTemplate(loadSyntheticTemplate(t, "many-txs.json"))
+	if full.TxCount != 300 {
+		t.Fatalf("expected 300 transactions, got %+v", full)
+	}
+}
+
+func TestSyntheticTemplateDiff(t *testing.T) {
+	previous := loadSyntheticTemplate(t, "many-txs.json")
+	current := loadSyntheticTemplate(t, "many-txs-next.json")
+
+	differ := NewTemplateDiffer(nil, DiffConfig{})
+	previousIDs, err := transactionIDs(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	differ.previous = previous
+	differ.previousPrint = templateFingerprint(previous)
+	differ.previousIDOrder = previousIDs
+	differ.previousIDs = make(map[string]bool)
+	for _, id := range previousIDs {
+		differ.previousIDs[id] = true
+	}
+
+	currentIDs, err := transactionIDs(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := differ.build(&TemplateEnvelope{Fingerprint: templateFingerprint(current)}, current, currentIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next template has a new coinbase, drops three transactions and
+	// adds five
+	if diff.Type != diffTypeDiff || len(diff.Added) != 6 || len(diff.Removed) != 4 {
+		t.Fatalf("unexpected diff: type %s, %d added, %d removed", diff.Type, len(diff.Added), len(diff.Removed))
+	}
+	if diff.PreviousFingerprint != differ.previousPrint {
+		t.Fatalf("diff is not keyed by the previous fingerprint")
+	}
+	if _, ok := diff.HeaderChanges["Parents"]; ok {
+		t.Fatalf("parents did not change but are listed in the header changes")
+	}
+	if _, ok := diff.HeaderChanges["HashMerkleRoot"]; !ok {
+		t.Fatalf("merkle root change missing from the header changes")
+	}
+}
+
+func TestDiffCanary(t *testing.T) {
+	clk := newFakeClock()
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	envelope := &TemplateEnvelope{Fingerprint: templateFingerprint(template), FetchedAt: clk.Now().UnixMilli()}
+
+	differ := NewTemplateDiffer(nil, DiffConfig{RedisChannel: "diffs"})
+	canary := NewDiffCanary("diffs", CanaryConfig{}, clk)
+	differ.SetCanary(canary)
+	var sent []byte
+	differ.send = func(ctx context.Context, payload []byte) error {
+		if sent == nil {
+			sent = payload
+			return errors.New("connection refused")
+		}
+		sent = payload
+		return nil
+	}
+
+	if err := differ.Publish(context.Background(), envelope, template); err == nil {
+		t.Fatalf("expected the publish error")
+	}
+	if canary.Pending() != 0 {
+		t.Fatalf("failed diff left pending on the canary")
+	}
+	if err := differ.Publish(context.Background(), envelope, template); err != nil {
+		t.Fatal(err)
+	}
+	canary.received(sent, clk.Now())
+	if canary.delivered != 1 || canary.Pending() != 0 || canary.lastSequence != 1 {
+		t.Fatalf("diff not matched by its canary")
+	}
+}
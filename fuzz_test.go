@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kaspanet/kaspad/util"
+)
+
+func FuzzDecodeConfig(f *testing.F) {
+	example, err := ioutil.ReadFile("config.json")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(example)
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"network": "testnet-11", "block_wait_time_seconds": "1"}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "-3"}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3"} {}`))
+	f.Add([]byte(`{"polling": {"min_interval_ms": 500, "max_interval_ms": 100}}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3", "loadgen": {"rate": 1e12}}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3", "alerts": {"interval_ms": -1, "rule_cooldowns": {"no_publish": 60}}}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3", "canary": {"late_threshold_ms": 500, "missing_timeout_ms": -1}}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3", "staleness": {"max_daa_steps": 10, "max_valid_ms": 30000, "expected_daa_step_ms": 100}}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3", "archive": {"retention_hours": -24}}`))
+	f.Add([]byte(`{"network": "mainnet", "block_wait_time_seconds": "3", "heartbeat": {"interval_ms": 1000}}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		config, err := decodeConfig(bytes.NewReader(data))
+		if err != nil {
+			if config != nil {
+				t.Fatalf("config returned along with error %v", err)
+			}
+			return
+		}
+		if err := config.validate(); err != nil {
+			t.Fatalf("accepted config does not validate: %v", err)
+		}
+
+		// Whatever was accepted must survive being written back out
+		encoded, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := decodeConfig(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("re-encoded config rejected: %v", err)
+		}
+		if !reflect.DeepEqual(config, again) {
+			t.Fatalf("config changed across a round trip: %+v != %+v", config, again)
+		}
+	})
+}
+
+func TestDecodeConfigRejectsInvalid(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`{`,
+		`{"network": "mainnet"}`,
+		`{"network": "devnet", "block_wait_time_seconds": "3"}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "0"}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "min_subscribers": -1}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3"} trailing`,
+		`{"network": 5, "block_wait_time_seconds": "3"}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "loadgen": {"rate": -1}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "alerts": {"interval_ms": -1}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "alerts": {"rule_cooldowns": {"no_publish": -5}}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "alerts": {"cooldown_seconds": 9300000000}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "canary": {"missing_timeout_ms": -1}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "staleness": {"max_valid_ms": -1}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "staleness": {"expected_daa_step_ms": -1000}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "archive": {"retention_hours": -24}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "loadgen": {"rate": 2e9}}`,
+		`{"network": "mainnet", "block_wait_time_seconds": "3", "heartbeat": {"interval_ms": 1000}}`,
+	} {
+		if _, err := decodeConfig(strings.NewReader(input)); err == nil {
+			t.Errorf("config %q was accepted", input)
+		}
+	}
+}
+
+const testPrivateKey = "b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef"
+
+func FuzzFetchKaspaAccountFromPrivateKey(f *testing.F) {
+	f.Add("mainnet", testPrivateKey)
+	f.Add("testnet-10", testPrivateKey)
+	f.Add("testnet-11", strings.ToUpper(testPrivateKey))
+	f.Add("mainnet", testPrivateKey[:62])
+	f.Add("mainnet", testPrivateKey+"00")
+	f.Add("mainnet", "zz"+testPrivateKey[2:])
+	f.Add("mainnet", strings.Repeat("0", 64))
+	f.Add("mainnet", "")
+
+	f.Fuzz(func(t *testing.T, network, privateKeyHex string) {
+		address, err := fetchKaspaAccountFromPrivateKey(network, privateKeyHex)
+		if err != nil {
+			return
+		}
+		if key, err := hex.DecodeString(privateKeyHex); err != nil || len(key) != 32 {
+			t.Fatalf("key %q accepted", privateKeyHex)
+		}
+		prefix := networkPrefix(network)
+		decoded, err := util.DecodeAddress(address, prefix)
+		if err != nil {
+			t.Fatalf("derived address %s does not decode: %v", address, err)
+		}
+		if decoded.Prefix() != prefix || decoded.EncodeAddress() != address {
+			t.Fatalf("derived address %s does not round trip with prefix %s", address, prefix)
+		}
+		if !strings.HasPrefix(address, prefix.String()+":") {
+			t.Fatalf("derived address %s lacks the %s prefix", address, prefix)
+		}
+	})
+}
+
+func TestFetchKaspaAccountFromPrivateKeyRejectsInvalid(t *testing.T) {
+	for _, key := range []string{
+		"",
+		testPrivateKey[:62],
+		testPrivateKey + "00",
+		"zz" + testPrivateKey[2:],
+		testPrivateKey[:63],
+		strings.Repeat("0", 64),
+	} {
+		if _, err := fetchKaspaAccountFromPrivateKey("mainnet", key); err == nil {
+			t.Errorf("key %q was accepted", key)
+		}
+	}
+}
@@ -1,13 +1,14 @@
 module getNewBlockTemplate
 
-go 1.18
+go 1.23
 
 require (
 	github.com/go-redis/redis/v8 v8.11.5
-	github.com/joho/godotenv v1.5.1
 	github.com/kaspanet/kaspad v0.12.19
+	github.com/mattn/go-sqlite3 v1.14.52
 	github.com/pkg/errors v0.9.1
 	golang.org/x/net v0.7.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
@@ -25,5 +26,4 @@ require (
 	golang.org/x/text v0.7.0 // indirect
 	google.golang.org/genproto v0.0.0-20210604141403-392c879c8b08 // indirect
 	google.golang.org/grpc v1.38.0 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
 )
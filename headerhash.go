@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// writeHeaderHash stores the current template's header fields and summary
+// in a Redis hash, so lightweight consumers can HGET single fields instead of
+// parsing the full template. All fields are written by a single HSET and
+// therefore always belong to the same template.
+func writeHeaderHash(ctx context.Context, rdb *redis.Client, key string, envelope *TemplateEnvelope,
+	template *appmessage.GetBlockTemplateResponseMessage) error {
+
+	if err := rdb.HSet(ctx, key, headerHashFields(envelope, template)...).Err(); err != nil {
+		return errors.Wrap(err, "error updating template header hash")
+	}
+	return nil
+}
+
+// headerHashFields returns the field and value pairs of the header hash.
+func headerHashFields(envelope *TemplateEnvelope, template *appmessage.GetBlockTemplateResponseMessage) []interface{} {
+	header := template.Block.Header
+	summary := summarizeTemplate(template)
+	return []interface{}{
+		"sequence", envelope.Sequence,
+		"fingerprint", envelope.Fingerprint,
+		"fetched_at", envelope.FetchedAt,
+		"published_at", envelope.PublishedAt,
+		"expires_at_daa_score", envelope.ExpiresAtDAAScore,
+		"expires_at", envelope.ExpiresAt,
+		"is_synced", template.IsSynced,
+		"version", header.Version,
+		"hash_merkle_root", header.HashMerkleRoot,
+		"accepted_id_merkle_root", header.AcceptedIDMerkleRoot,
+		"utxo_commitment", header.UTXOCommitment,
+		"timestamp", header.Timestamp,
+		"bits", header.Bits,
+		"daa_score", header.DAAScore,
+		"blue_score", header.BlueScore,
+		"blue_work", header.BlueWork,
+		"pruning_point", header.PruningPoint,
+		"tx_count", summary.TxCount,
+		"coinbase_value", summary.CoinbaseValue,
+		"merged_fees", summary.MergedFees,
+	}
+}
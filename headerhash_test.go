@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeaderHashFields(t *testing.T) {
+	clk := newFakeClock()
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	template.IsSynced = true
+	envelope := &TemplateEnvelope{Sequence: 3, Fingerprint: templateFingerprint(template),
+		FetchedAt: clk.Now().UnixMilli(), PublishedAt: clk.Now().Add(time.Millisecond).UnixMilli(),
+		ExpiresAtDAAScore: template.Block.Header.DAAScore + 4, ExpiresAt: clk.Now().Add(4 * time.Second).UnixMilli()}
+
+	pairs := headerHashFields(envelope, template)
+	if len(pairs)%2 != 0 {
+		t.Fatalf("odd number of field and value arguments: %d", len(pairs))
+	}
+	fields := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		name, ok := pairs[i].(string)
+		if !ok {
+			t.Fatalf("field name %v is not a string", pairs[i])
+		}
+		if _, ok := fields[name]; ok {
+			t.Fatalf("field %s written twice", name)
+		}
+		fields[name] = pairs[i+1]
+	}
+
+	header := template.Block.Header
+	summary := summarizeTemplate(template)
+	want := map[string]interface{}{
+		"sequence":                envelope.Sequence,
+		"fingerprint":             envelope.Fingerprint,
+		"fetched_at":              envelope.FetchedAt,
+		"published_at":            envelope.PublishedAt,
+		"expires_at_daa_score":    envelope.ExpiresAtDAAScore,
+		"expires_at":              envelope.ExpiresAt,
+		"is_synced":               true,
+		"version":                 header.Version,
+		"hash_merkle_root":        header.HashMerkleRoot,
+		"accepted_id_merkle_root": header.AcceptedIDMerkleRoot,
+		"utxo_commitment":         header.UTXOCommitment,
+		"timestamp":               header.Timestamp,
+		"bits":                    header.Bits,
+		"daa_score":               header.DAAScore,
+		"blue_score":              header.BlueScore,
+		"blue_work":               header.BlueWork,
+		"pruning_point":           header.PruningPoint,
+		"tx_count":                300,
+		"coinbase_value":          summary.CoinbaseValue,
+		"merged_fees":             summary.MergedFees,
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("expected %d fields, got %d: %v", len(want), len(fields), fields)
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("field %s is %v (%T), expected %v (%T)", name, fields[name], fields[name], value, value)
+		}
+	}
+}
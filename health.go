@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// fetcherHealth tracks the outcome of recent fetches, and separately whether
+// the nodes answered, since a fetch also fails when publishing does.
+type fetcherHealth struct {
+	clock     clock
+	startedAt time.Time
+
+	mutex               sync.Mutex
+	lastSuccess         time.Time
+	lastError           string
+	lastErrorAt         time.Time
+	consecutiveFailures int
+	synced              bool
+	nodeFailures        int
+	lastNodeError       string
+}
+
+func newFetcherHealth(clk clock) *fetcherHealth {
+	return &fetcherHealth{clock: clk, startedAt: clk.Now()}
+}
+
+func (h *fetcherHealth) Success(synced bool, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastSuccess = now
+	h.consecutiveFailures = 0
+	h.synced = synced
+}
+
+func (h *fetcherHealth) Failure(err error, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastError = err.Error()
+	h.lastErrorAt = now
+	h.consecutiveFailures++
+}
+
+// NodeFailure records a fetch round in which every node failed.
+func (h *fetcherHealth) NodeFailure(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.nodeFailures++
+	h.lastNodeError = err.Error()
+}
+
+// NodeSuccess records a fetch round in which a node returned a template.
+func (h *fetcherHealth) NodeSuccess() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.nodeFailures = 0
+}
+
+type healthSnapshot struct {
+	Healthy             bool   `json:"healthy"`
+	Synced              bool   `json:"synced"`
+	LastSuccess         int64  `json:"last_success,omitempty"`
+	LastError           string `json:"last_error,omitempty"`
+	LastErrorAt         int64  `json:"last_error_at,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	NodeFailures        int    `json:"node_failures"`
+	LastNodeError       string `json:"last_node_error,omitempty"`
+	UptimeSeconds       int64  `json:"uptime_seconds"`
+}
+
+func (h *fetcherHealth) Snapshot() healthSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	snapshot := healthSnapshot{
+		Healthy:             !h.lastSuccess.IsZero() && h.consecutiveFailures == 0,
+		Synced:              h.synced,
+		LastError:           h.lastError,
+		ConsecutiveFailures: h.consecutiveFailures,
+		NodeFailures:        h.nodeFailures,
+		LastNodeError:       h.lastNodeError,
+		UptimeSeconds:       int64(h.clock.Now().Sub(h.startedAt).Seconds()),
+	}
+	if !h.lastSuccess.IsZero() {
+		snapshot.LastSuccess = h.lastSuccess.UnixMilli()
+	}
+	if !h.lastErrorAt.IsZero() {
+		snapshot.LastErrorAt = h.lastErrorAt.UnixMilli()
+	}
+	return snapshot
+}
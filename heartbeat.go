@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+type HeartbeatConfig struct {
+	IntervalMs   int64  `json:"interval_ms"`
+	RedisChannel string `json:"redis_channel"`
+}
+
+const messageTypeHeartbeat = "heartbeat"
+
+// heartbeatMessage lets consumers tell an idle feed from a dead fetcher.
+type heartbeatMessage struct {
+	Type            string         `json:"type"`
+	SentAt          int64          `json:"sent_at"`
+	LastSequence    uint64         `json:"last_sequence"`
+	LastFingerprint string         `json:"last_fingerprint"`
+	Node            healthSnapshot `json:"node"`
+	Build           string         `json:"build"`
+}
+
+// heartbeats publishes a heartbeat every interval. When no channel is
+// configured the template channel is used, in which case consumers tell
+// messages apart by their "type" field, which requires envelopes to be
+// enabled.
+type heartbeats struct {
+	clock     clock
+	channel   string
+	interval  time.Duration
+	publisher *TemplatePublisher
+	health    *fetcherHealth
+	// canary watches a dedicated heartbeat channel, nil otherwise
+	canary *DeliveryCanary
+	// send publishes one heartbeat, replaced in tests
+	send func(ctx context.Context, payload []byte) error
+}
+
+func newHeartbeats(rdb *redis.Client, config HeartbeatConfig, channel string, publisher *TemplatePublisher,
+	health *fetcherHealth, clk clock) *heartbeats {
+
+	if config.RedisChannel != "" {
+		channel = config.RedisChannel
+	}
+	return &heartbeats{
+		clock:     clk,
+		channel:   channel,
+		interval:  time.Duration(config.IntervalMs) * time.Millisecond,
+		publisher: publisher,
+		health:    health,
+		send: func(ctx context.Context, payload []byte) error {
+			return rdb.Publish(ctx, channel, payload).Err()
+		},
+	}
+}
+
+// Run publishes heartbeats until ctx is done.
+func (h *heartbeats) Run(ctx context.Context) {
+	ticks, stop := h.clock.Tick(h.interval)
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticks:
+			sequence, fingerprint := h.publisher.Last()
+			payload, err := json.Marshal(&heartbeatMessage{
+				Type:            messageTypeHeartbeat,
+				SentAt:          now.UnixMilli(),
+				LastSequence:    sequence,
+				LastFingerprint: fingerprint,
+				Node:            h.health.Snapshot(),
+				Build:           currentBuild().Short(),
+			})
+			if err != nil {
+				log.Printf("error serializing heartbeat: %v", err)
+				continue
+			}
+			key := heartbeatKey(now.UnixMilli())
+			if h.canary != nil {
+				h.canary.expect(key, now)
+			}
+			if err := h.send(ctx, payload); err != nil {
+				if h.canary != nil {
+					h.canary.cancel(key)
+				}
+				log.Printf("error publishing heartbeat to %s: %v", h.channel, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHeartbeats(t *testing.T) {
+	clk := newFakeClock()
+	publisher := NewTemplatePublisher(nil, "templates", true, clk)
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		return 1, nil
+	}
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	envelope, err := publisher.Publish(context.Background(), template, clk.Now(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := newFetcherHealth(clk)
+	health.Success(true, clk.Now())
+
+	if h := newHeartbeats(nil, HeartbeatConfig{IntervalMs: 1000, RedisChannel: "heartbeats"}, "templates",
+		publisher, health, clk); h.channel != "heartbeats" {
+		t.Fatalf("heartbeats go to %s instead of the configured channel", h.channel)
+	}
+	h := newHeartbeats(nil, HeartbeatConfig{IntervalMs: 1000}, "templates", publisher, health, clk)
+	if h.channel != "templates" {
+		t.Fatalf("heartbeats go to %s instead of the template channel", h.channel)
+	}
+	sent := make(chan []byte, 1)
+	h.send = func(ctx context.Context, payload []byte) error {
+		sent <- payload
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	clk.waitForTimer(time.Second)
+	clk.Advance(time.Second)
+	payload := <-sent
+	var heartbeat heartbeatMessage
+	if err := json.Unmarshal(payload, &heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.Type != messageTypeHeartbeat || heartbeat.SentAt != clk.Now().UnixMilli() ||
+		heartbeat.LastSequence != envelope.Sequence || heartbeat.LastFingerprint != envelope.Fingerprint {
+		t.Fatalf("unexpected heartbeat %+v", heartbeat)
+	}
+	if !heartbeat.Node.Healthy || !heartbeat.Node.Synced || heartbeat.Node.UptimeSeconds != 1 {
+		t.Fatalf("unexpected node health %+v", heartbeat.Node)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["uptime_seconds"]; ok {
+		t.Fatalf("uptime is reported twice: %s", payload)
+	}
+}
+
+func TestHeartbeatCanary(t *testing.T) {
+	clk := newFakeClock()
+	publisher := NewTemplatePublisher(nil, "templates", true, clk)
+	h := newHeartbeats(nil, HeartbeatConfig{IntervalMs: 1000, RedisChannel: "heartbeats"}, "templates",
+		publisher, newFetcherHealth(clk), clk)
+	h.canary = NewHeartbeatCanary("heartbeats", CanaryConfig{}, clk)
+	sent := make(chan []byte, 1)
+	h.send = func(ctx context.Context, payload []byte) error {
+		sent <- payload
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+
+	clk.waitForTimer(time.Second)
+	clk.Advance(time.Second)
+	payload := <-sent
+	if h.canary.Pending() != 1 {
+		t.Fatalf("heartbeat not announced to the canary")
+	}
+	h.canary.received(payload, clk.Now())
+	if h.canary.delivered != 1 || h.canary.Pending() != 0 {
+		t.Fatalf("heartbeat not matched by its canary")
+	}
+}
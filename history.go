@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type HistoryConfig struct {
+	RecordPath   string `json:"record_path"`
+	RedisStream  string `json:"redis_stream"`
+	StreamMaxLen int64  `json:"stream_max_len"`
+}
+
+// historyRecord is the per-template row kept by the archive, the disk
+// recording and the history stream, and emitted by the export command.
+type historyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Sequence    uint64 `json:"sequence"`
+	Node        string `json:"node"`
+	FetchedAt   int64  `json:"fetched_at"`
+	PublishedAt int64  `json:"published_at"`
+	templateSummary
+	// Fees is the total fee of the template's transactions, from the
+	// mempool of the node it was fetched from
+	Fees             uint64  `json:"fees"`
+	FetchLatencyMs   float64 `json:"fetch_latency_ms"`
+	PublishLatencyMs float64 `json:"publish_latency_ms"`
+}
+
+func newHistoryRecord(node string, envelope *TemplateEnvelope, template *appmessage.GetBlockTemplateResponseMessage,
+	fetchLatency time.Duration) *historyRecord {
+
+	fetchLatencyMs := float64(fetchLatency) / float64(time.Millisecond)
+	return &historyRecord{
+		Fingerprint:      envelope.Fingerprint,
+		Sequence:         envelope.Sequence,
+		Node:             node,
+		FetchedAt:        envelope.FetchedAt,
+		PublishedAt:      envelope.PublishedAt,
+		templateSummary:  summarizeTemplate(template),
+		FetchLatencyMs:   fetchLatencyMs,
+		PublishLatencyMs: float64(envelope.PublishedAt-envelope.FetchedAt) - fetchLatencyMs,
+	}
+}
+
+// TemplateHistory appends history records to an NDJSON recording on disk
+// and/or a capped Redis stream.
+type TemplateHistory struct {
+	file   *os.File
+	rdb    *redis.Client
+	config HistoryConfig
+}
+
+func NewTemplateHistory(config HistoryConfig, rdb *redis.Client) (*TemplateHistory, error) {
+	history := &TemplateHistory{rdb: rdb, config: config}
+	if config.RecordPath != "" {
+		file, err := os.OpenFile(config.RecordPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed opening template recording")
+		}
+		history.file = file
+	}
+	if history.config.StreamMaxLen == 0 {
+		history.config.StreamMaxLen = 100000
+	}
+	return history, nil
+}
+
+func (h *TemplateHistory) Record(ctx context.Context, record *historyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if h.file != nil {
+		if _, err := h.file.Write(append(data, '\n')); err != nil {
+			return errors.Wrap(err, "failed writing template recording")
+		}
+	}
+	if h.config.RedisStream != "" {
+		err := h.rdb.XAdd(ctx, &redis.XAddArgs{
+			Stream: h.config.RedisStream,
+			MaxLen: h.config.StreamMaxLen,
+			Approx: true,
+			Values: map[string]interface{}{"record": data},
+		}).Err()
+		if err != nil {
+			return errors.Wrap(err, "failed adding to history stream")
+		}
+	}
+	return nil
+}
+
+// readRecording calls fn for every record in an NDJSON recording.
+func readRecording(path string, fn func(*historyRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return errors.Wrapf(err, "%s:%d", path, line)
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readHistoryStream calls fn for every record in the stream between from and
+// to. Stream IDs start with the insertion time in millis, so the range is
+// resolved by Redis itself.
+func readHistoryStream(ctx context.Context, rdb *redis.Client, stream string, from, to time.Time,
+	fn func(*historyRecord) error) error {
+
+	start := strconv.FormatInt(from.UnixMilli(), 10)
+	end := strconv.FormatInt(to.UnixMilli(), 10)
+	for {
+		messages, err := rdb.XRangeN(ctx, stream, start, end, 1000).Result()
+		if err != nil {
+			return errors.Wrap(err, "failed reading history stream")
+		}
+		for _, message := range messages {
+			data, _ := message.Values["record"].(string)
+			var record historyRecord
+			if err := json.Unmarshal([]byte(data), &record); err != nil {
+				return errors.Wrapf(err, "stream entry %s", message.ID)
+			}
+			if err := fn(&record); err != nil {
+				return err
+			}
+		}
+		if len(messages) < 1000 {
+			return nil
+		}
+		start = "(" + messages[len(messages)-1].ID
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type LoadgenConfig struct {
+	Rate          float64 `json:"rate"`
+	BlockRate     float64 `json:"block_rate"`
+	TxCount       int     `json:"tx_count"`
+	TxSize        int     `json:"tx_size"`
+	RedisChannel  string  `json:"redis_channel"`
+	TemplateCount int     `json:"template_count"`
+	// BareTemplates publishes templates without an envelope, so there is
+	// no sequence or clean_jobs flag
+	BareTemplates bool `json:"bare_templates"`
+}
+
+// maxLoadgenRate caps the publish rate, well above what a stratum server can
+// be expected to take and far from the rates that break the ticker.
+const maxLoadgenRate = 10000
+
+// setDefaults fills in the settings left at zero, except the channel.
+func (lg *LoadgenConfig) setDefaults() {
+	if lg.Rate == 0 {
+		lg.Rate = 1
+	}
+	if lg.BlockRate == 0 {
+		lg.BlockRate = 1
+	}
+	if lg.TxSize == 0 {
+		lg.TxSize = 66
+	}
+}
+
+func (lg *LoadgenConfig) validate() error {
+	if !(lg.Rate > 0 && lg.Rate <= maxLoadgenRate) {
+		return errors.Errorf("loadgen rate must be in (0, %d], got %v", maxLoadgenRate, lg.Rate)
+	}
+	if !(lg.BlockRate >= 0 && lg.BlockRate <= maxLoadgenRate) || lg.TxCount < 0 || lg.TxSize < 0 {
+		return errors.Errorf("invalid loadgen settings: %+v", *lg)
+	}
+	return nil
+}
+
+const (
+	coinbaseSubnetworkID = "0100000000000000000000000000000000000000"
+	nativeSubnetworkID   = "0000000000000000000000000000000000000000"
+)
+
+// syntheticTemplates produces a stream of realistic looking block templates.
+// Parents only change (and DAA/blue scores only advance) on simulated block
+// arrivals, so consumers see the same clean-jobs pattern a node would give.
+type syntheticTemplates struct {
+	rng       *rand.Rand
+	config    LoadgenConfig
+	daaScore  uint64
+	blueScore uint64
+	parents   []string
+}
+
+func newSyntheticTemplates(config LoadgenConfig) *syntheticTemplates {
+	g := &syntheticTemplates{
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		config:    config,
+		daaScore:  80_000_000,
+		blueScore: 78_000_000,
+	}
+	g.advance()
+	return g
+}
+
+func (g *syntheticTemplates) randomHex(n int) string {
+	b := make([]byte, n)
+	g.rng.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// advance simulates a new block being added to the DAG.
+func (g *syntheticTemplates) advance() {
+	steps := uint64(1 + g.rng.Intn(3))
+	g.daaScore += steps
+	g.blueScore += steps
+	g.parents = make([]string, 1+g.rng.Intn(4))
+	for i := range g.parents {
+		g.parents[i] = g.randomHex(32)
+	}
+}
+
+func (g *syntheticTemplates) coinbase() *appmessage.RPCTransaction {
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload[:8], g.blueScore)
+	binary.LittleEndian.PutUint64(payload[8:], 12_000_000_000)
+	return &appmessage.RPCTransaction{
+		Outputs: []*appmessage.RPCTransactionOutput{{
+			Amount:          12_000_000_000 + uint64(g.rng.Intn(10_000_000)),
+			ScriptPublicKey: &appmessage.RPCScriptPublicKey{Script: "20" + g.randomHex(32) + "ac"},
+		}},
+		SubnetworkID: coinbaseSubnetworkID,
+		Payload:      hex.EncodeToString(payload) + "0000" + "22" + g.randomHex(34) + hex.EncodeToString([]byte("Katpool")),
+	}
+}
+
+func (g *syntheticTemplates) transaction() *appmessage.RPCTransaction {
+	return &appmessage.RPCTransaction{
+		Inputs: []*appmessage.RPCTransactionInput{{
+			PreviousOutpoint: &appmessage.RPCOutpoint{TransactionID: g.randomHex(32), Index: uint32(g.rng.Intn(4))},
+			SignatureScript:  g.randomHex(g.config.TxSize),
+			SigOpCount:       1,
+		}},
+		Outputs: []*appmessage.RPCTransactionOutput{
+			{Amount: uint64(g.rng.Int63n(1_000_000_000_000)), ScriptPublicKey: &appmessage.RPCScriptPublicKey{Script: "20" + g.randomHex(32) + "ac"}},
+			{Amount: uint64(g.rng.Int63n(1_000_000_000_000)), ScriptPublicKey: &appmessage.RPCScriptPublicKey{Script: "20" + g.randomHex(32) + "ac"}},
+		},
+		SubnetworkID: nativeSubnetworkID,
+	}
+}
+
+func (g *syntheticTemplates) next() *appmessage.GetBlockTemplateResponseMessage {
+	if g.rng.Float64() < g.config.BlockRate/g.config.Rate {
+		g.advance()
+	}
+
+	transactions := make([]*appmessage.RPCTransaction, 0, g.config.TxCount+1)
+	transactions = append(transactions, g.coinbase())
+	for i := 0; i < g.config.TxCount; i++ {
+		transactions = append(transactions, g.transaction())
+	}
+
+	return appmessage.NewGetBlockTemplateResponseMessage(&appmessage.RPCBlock{
+		Header: &appmessage.RPCBlockHeader{
+			Version:              1,
+			Parents:              []*appmessage.RPCBlockLevelParents{{ParentHashes: g.parents}},
+			HashMerkleRoot:       g.randomHex(32),
+			AcceptedIDMerkleRoot: g.randomHex(32),
+			UTXOCommitment:       g.randomHex(32),
+			Timestamp:            time.Now().UnixMilli(),
+			Bits:                 0x1c00ffff,
+			DAAScore:             g.daaScore,
+			BlueScore:            g.blueScore,
+			BlueWork:             g.randomHex(12),
+			PruningPoint:         g.randomHex(32),
+		},
+		Transactions: transactions,
+	}, true)
+}
+
+// runLoadgen publishes synthetic templates instead of fetching them from a
+// node, so stratum servers can be benchmarked at rates the network does not
+// produce yet. Flags override the "loadgen" section of the config.
+func runLoadgen(config *BridgeConfig, args []string) error {
+	lg := config.Loadgen
+	lg.setDefaults()
+	if lg.RedisChannel == "" {
+		lg.RedisChannel = config.RedisChannel
+	}
+
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	flags.Float64Var(&lg.Rate, "rate", lg.Rate, "templates published per second (e.g. 1, 10 or 100)")
+	flags.Float64Var(&lg.BlockRate, "block-rate", lg.BlockRate, "simulated blocks per second, each one is a clean-jobs event")
+	flags.IntVar(&lg.TxCount, "txs", lg.TxCount, "non-coinbase transactions per template")
+	flags.IntVar(&lg.TxSize, "tx-size", lg.TxSize, "signature script size in bytes of each transaction")
+	flags.StringVar(&lg.RedisChannel, "channel", lg.RedisChannel, "redis channel to publish to")
+	flags.IntVar(&lg.TemplateCount, "count", lg.TemplateCount, "stop after publishing this many templates (0 runs forever)")
+	flags.BoolVar(&lg.BareTemplates, "bare", lg.BareTemplates, "publish templates without an envelope")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := lg.validate(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{
+		Addr: config.RedisAddress,
+	})
+	defer rdb.Close()
+
+	if _, err := rdb.Ping(ctx).Result(); err != nil {
+		return errors.Wrap(err, "could not connect to Redis")
+	}
+
+	publisher := NewTemplatePublisher(rdb, lg.RedisChannel, !lg.BareTemplates, realClock{})
+	published, failed := publishSynthetic(ctx, lg, publisher, realClock{})
+	log.Printf("loadgen done: %d published, %d failed", published, failed)
+	return nil
+}
+
+// publishSynthetic publishes generated templates at the configured rate
+// until the template count is reached.
+func publishSynthetic(ctx context.Context, lg LoadgenConfig, publisher *TemplatePublisher, clk clock) (int, int) {
+	generator := newSyntheticTemplates(lg)
+	log.Printf("loadgen publishing %v templates/s (%v blocks/s, %d txs of %d bytes) to %s",
+		lg.Rate, lg.BlockRate, lg.TxCount, lg.TxSize, lg.RedisChannel)
+
+	ticks, stop := clk.Tick(time.Duration(float64(time.Second) / lg.Rate))
+	defer stop()
+	report, stopReport := clk.Tick(10 * time.Second)
+	defer stopReport()
+
+	published, failed := 0, 0
+	for lg.TemplateCount == 0 || published < lg.TemplateCount {
+		select {
+		case <-report:
+			log.Printf("loadgen: %d published, %d failed", published, failed)
+		case <-ticks:
+			template := generator.next()
+			if _, err := publisher.Publish(ctx, template, clk.Now(), nil, nil); err != nil {
+				log.Printf("%v", err)
+				failed++
+				continue
+			}
+			published++
+		}
+	}
+	return published, failed
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"golang.org/x/net/context"
+)
+
+func TestLoadgenPublishesEnvelopes(t *testing.T) {
+	lg := LoadgenConfig{Rate: 10, BlockRate: 5, TxCount: 3, TemplateCount: 20}
+	lg.setDefaults()
+	clk := newFakeClock()
+	publisher := NewTemplatePublisher(nil, "templates", !lg.BareTemplates, clk)
+	sent := make(chan []byte, 1)
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		sent <- messages[0]
+		return 1, nil
+	}
+	done := make(chan int)
+	go func() {
+		published, _ := publishSynthetic(context.Background(), lg, publisher, clk)
+		done <- published
+	}()
+
+	var previous *TemplateEnvelope
+	for i := 1; i <= lg.TemplateCount; i++ {
+		clk.waitForTimer(100 * time.Millisecond)
+		clk.Advance(100 * time.Millisecond)
+		var envelope TemplateEnvelope
+		if err := json.Unmarshal(<-sent, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		if envelope.Type != messageTypeTemplate || envelope.Sequence != uint64(i) ||
+			envelope.FetchedAt != clk.Now().UnixMilli() || envelope.Fingerprint != templateFingerprint(envelope.Template) {
+			t.Fatalf("unexpected envelope %d: %+v", i, envelope)
+		}
+		if len(envelope.Template.Block.Transactions) != lg.TxCount+1 {
+			t.Fatalf("expected %d transactions, got %d", lg.TxCount+1, len(envelope.Template.Block.Transactions))
+		}
+		newBlock := previous == nil || parentsKey(envelope.Template) != parentsKey(previous.Template)
+		if envelope.CleanJobs != newBlock {
+			t.Fatalf("envelope %d has clean_jobs %v on a template with new parents %v", i, envelope.CleanJobs, newBlock)
+		}
+		if previous != nil && newBlock && envelope.Template.Block.Header.DAAScore <= previous.Template.Block.Header.DAAScore {
+			t.Fatalf("DAA score did not advance with the block")
+		}
+		previous = &envelope
+	}
+	if published := <-done; published != lg.TemplateCount {
+		t.Fatalf("expected %d templates published, got %d", lg.TemplateCount, published)
+	}
+}
+
+func TestLoadgenBareTemplates(t *testing.T) {
+	lg := LoadgenConfig{TxCount: 1, TemplateCount: 1, BareTemplates: true}
+	lg.setDefaults()
+	clk := newFakeClock()
+	publisher := NewTemplatePublisher(nil, "templates", !lg.BareTemplates, clk)
+	sent := make(chan []byte, 1)
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		sent <- messages[0]
+		return 1, nil
+	}
+	go publishSynthetic(context.Background(), lg, publisher, clk)
+
+	clk.waitForTimer(time.Second)
+	clk.Advance(time.Second)
+	var fields map[string]json.RawMessage
+	payload := <-sent
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["sequence"]; ok {
+		t.Fatalf("bare template published in an envelope")
+	}
+	var template appmessage.GetBlockTemplateResponseMessage
+	if err := json.Unmarshal(payload, &template); err != nil || len(template.Block.Transactions) != 2 {
+		t.Fatalf("expected a bare template with 2 transactions, got %s", payload)
+	}
+}
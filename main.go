@@ -4,16 +4,17 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	// "github.com/joho/godotenv"
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/cmd/kaspawallet/libkaspawallet"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
 	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
 	"github.com/kaspanet/kaspad/util"
 	"github.com/pkg/errors"
@@ -28,11 +29,134 @@ type KaspaApi struct {
 }
 
 type BridgeConfig struct {
-	RPCServer        []string `json:"node"`
-	Network 		 string   `json:"network"`
-	BlockWaitTimeSec string   `json:"block_wait_time_seconds"`
-	RedisAddress     string   `json:"redis_address"`
-	RedisChannel     string   `json:"redis_channel"`
+	RPCServer        []string        `json:"node"`
+	Network          string          `json:"network"`
+	BlockWaitTimeSec string          `json:"block_wait_time_seconds"`
+	RedisAddress     string          `json:"redis_address"`
+	RedisChannel     string          `json:"redis_channel"`
+	PublishEnvelope  bool            `json:"publish_envelope"`
+	HTTPListen       string          `json:"http_listen"`
+	MinSubscribers   int64           `json:"min_subscribers"`
+	Canary           CanaryConfig    `json:"canary"`
+	Persist          PersistConfig   `json:"persist"`
+	Archive          ArchiveConfig   `json:"archive"`
+	History          HistoryConfig   `json:"history"`
+	Diff             DiffConfig      `json:"diff"`
+	HeaderHashKey    string          `json:"header_hash_key"`
+	Requests         RequestConfig   `json:"requests"`
+	Polling          PollingConfig   `json:"polling"`
+	Heartbeat        HeartbeatConfig `json:"heartbeat"`
+	Registry         RegistryConfig  `json:"registry"`
+	AdminListen      string          `json:"admin_listen"`
+	Alerts           AlertsConfig    `json:"alerts"`
+	Staleness        StalenessConfig `json:"staleness"`
+	Selection        SelectionConfig `json:"selection"`
+	Channels         []ChannelConfig `json:"channels"`
+	Chunking         ChunkingConfig  `json:"chunking"`
+	Events           EventsConfig    `json:"events"`
+	Assembly         AssemblyConfig  `json:"assembly"`
+	Loadgen          LoadgenConfig   `json:"loadgen"`
+}
+
+func loadConfig(path string) (*BridgeConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening file")
+	}
+	defer file.Close()
+	return decodeConfig(file)
+}
+
+// decodeConfig decodes a single JSON config document from r and validates it.
+func decodeConfig(r io.Reader) (*BridgeConfig, error) {
+	var config BridgeConfig
+	decoder := json.NewDecoder(r)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, errors.Wrap(err, "error decoding JSON")
+	}
+	if decoder.More() {
+		return nil, errors.New("error decoding JSON: unexpected data after config")
+	}
+	if err := config.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid config")
+	}
+	return &config, nil
+}
+
+// Upper bounds for durations in the config, far beyond any sensible setting
+// and well inside the range of time.Duration.
+const (
+	maxConfigMs      = int64(30 * 24 * time.Hour / time.Millisecond)
+	maxConfigSeconds = maxConfigMs / 1000
+	maxConfigHours   = int64(10 * 365 * 24)
+)
+
+// checkRange returns an error naming the setting when value is outside
+// [0, max].
+func checkRange(name string, value, max int64) error {
+	if value < 0 || value > max {
+		return errors.Errorf("%s must be between 0 and %d, got %d", name, max, value)
+	}
+	return nil
+}
+
+func (c *BridgeConfig) validate() error {
+	switch c.Network {
+	case "mainnet", "testnet-10", "testnet-11":
+	default:
+		return errors.Errorf("unknown network %q", c.Network)
+	}
+	if num, err := strconv.Atoi(c.BlockWaitTimeSec); err != nil || num <= 0 {
+		return errors.Errorf("block_wait_time_seconds must be a positive integer, got %q", c.BlockWaitTimeSec)
+	}
+	if c.MinSubscribers < 0 {
+		return errors.New("min_subscribers must not be negative")
+	}
+	if c.Heartbeat.IntervalMs < 0 || c.Registry.IntervalMs < 0 || c.Requests.MinIntervalMs < 0 {
+		return errors.New("intervals must not be negative")
+	}
+	if c.Heartbeat.IntervalMs > 0 && c.Heartbeat.RedisChannel == "" && !c.PublishEnvelope {
+		return errors.New("heartbeats on the template channel need publish_envelope, " +
+			"set heartbeat.redis_channel to publish bare templates")
+	}
+	if c.Polling.MinIntervalMs < 0 || c.Polling.MaxIntervalMs < 0 ||
+		(c.Polling.MaxIntervalMs > 0 && c.Polling.MinIntervalMs > c.Polling.MaxIntervalMs) {
+		return errors.Errorf("invalid polling interval range [%d, %d]", c.Polling.MinIntervalMs, c.Polling.MaxIntervalMs)
+	}
+	switch c.Selection.Policy {
+	case "", policyBlueWork, policyFees, policyLatency, policyPreferred:
+	default:
+		return errors.Errorf("unknown selection policy %q", c.Selection.Policy)
+	}
+	if c.Selection.SwitchMarginPercent < 0 || c.Selection.MinHoldMs < 0 || c.Selection.NodeTimeoutMs < 0 {
+		return errors.New("selection margin, hold time and node timeout must not be negative")
+	}
+	if err := c.Alerts.validate(); err != nil {
+		return err
+	}
+	if err := c.Canary.validate(); err != nil {
+		return err
+	}
+	if err := c.Staleness.validate(); err != nil {
+		return err
+	}
+	if err := checkRange("archive.retention_hours", int64(c.Archive.RetentionHours), maxConfigHours); err != nil {
+		return err
+	}
+	loadgen := c.Loadgen
+	loadgen.setDefaults()
+	if err := loadgen.validate(); err != nil {
+		return err
+	}
+	if err := c.Chunking.validate(); err != nil {
+		return err
+	}
+	for i := range c.Channels {
+		if err := c.Channels[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func NewKaspaAPI(address string, blockWaitTime time.Duration) (*KaspaApi, error) {
@@ -49,16 +173,49 @@ func NewKaspaAPI(address string, blockWaitTime time.Duration) (*KaspaApi, error)
 	}, nil
 }
 
-func fetchKaspaAccountFromPrivateKey(network, privateKeyHex string) (string, error) {
-	prefix := util.Bech32PrefixKaspa
-	if network == "testnet-10" || network == "testnet-11"{
-		prefix = util.Bech32PrefixKaspaTest
+func networkPrefix(network string) util.Bech32Prefix {
+	if network == "testnet-10" || network == "testnet-11" {
+		return util.Bech32PrefixKaspaTest
+	}
+	return util.Bech32PrefixKaspa
+}
+
+// nodeAddresses returns the configured kaspad RPC addresses, falling back to
+// the kaspad container for the network when none are set.
+func (c *BridgeConfig) nodeAddresses() []string {
+	var addresses []string
+	for _, address := range c.RPCServer {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, nodeAddress(c.Network))
 	}
+	return addresses
+}
+
+// nodeAddress returns the RPC address of the kaspad container for network.
+func nodeAddress(network string) string {
+	rpcUrl := "kaspad:16110"
+	if network == "testnet-10" {
+		rpcUrl = "kaspad:16210"
+	} else if network == "testnet-11" {
+		rpcUrl = "kaspad:16310"
+	}
+	return rpcUrl
+}
+
+func fetchKaspaAccountFromPrivateKey(network, privateKeyHex string) (string, error) {
+	prefix := networkPrefix(network)
 
 	privateKeyBytes, err := hex.DecodeString(privateKeyHex)
 	if err != nil {
 		return "", err
 	}
+	if len(privateKeyBytes) != 32 {
+		return "", errors.Errorf("private key must be 32 bytes, got %d", len(privateKeyBytes))
+	}
 
 	publicKeybytes, err := libkaspawallet.PublicKeyFromPrivateKey(privateKeyBytes)
 	if err != nil {
@@ -78,6 +235,19 @@ func fetchKaspaAccountFromPrivateKey(network, privateKeyHex string) (string, err
 	return address.EncodeAddress(), nil
 }
 
+// addressScript returns the script public key paying to address.
+func addressScript(network, address string) ([]byte, error) {
+	decoded, err := util.DecodeAddress(address, networkPrefix(network))
+	if err != nil {
+		return nil, err
+	}
+	script, err := txscript.PayToAddrScript(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return script.Script, nil
+}
+
 func (ks *KaspaApi) GetBlockTemplate(miningAddr string) (*appmessage.GetBlockTemplateResponseMessage, error) {
 	template, err := ks.kaspad.GetBlockTemplate(miningAddr,
 		"Katpool")
@@ -88,6 +258,14 @@ func (ks *KaspaApi) GetBlockTemplate(miningAddr string) (*appmessage.GetBlockTem
 	return template, nil
 }
 
+func (ks *KaspaApi) GetMempoolEntries() (*appmessage.GetMempoolEntriesResponseMessage, error) {
+	entries, err := ks.kaspad.GetMempoolEntries(false, false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed fetching mempool entries from kaspa")
+	}
+	return entries, nil
+}
+
 func main() {
 	// Step 1: Load .env file
 	// err := godotenv.Load(".env")
@@ -95,26 +273,42 @@ func main() {
 	// 	log.Fatalf("Error loading .env file: %v", err)
 	// }
 
-	// Step 2: Read environment variables
-	privateKey := os.Getenv("TREASURY_PRIVATE_KEY")
-
-	// Open the JSON file
-	file, err := os.Open("./config/config.json")
-	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
+	build := currentBuild()
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(build)
 		return
 	}
-	defer file.Close()
+	log.Printf("block template fetcher %s", build)
 
-	// Decode JSON into the struct
-	var config BridgeConfig
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	config, err := loadConfig("./config/config.json")
 	if err != nil {
-		fmt.Printf("Error decoding JSON: %v\n", err)
+		fmt.Printf("%v\n", err)
+		return
+	}
+	log.Printf("Config : %+v", *config)
+
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "loadgen":
+			err = runLoadgen(config, os.Args[2:])
+		case "query":
+			err = runQuery(config, os.Args[2:])
+		case "export":
+			err = runExport(config, os.Args[2:])
+		case "capture":
+			err = runCapture(config, os.Args[2:])
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
 		return
 	}
-	log.Println("Config : %v", config)
+
+	// Step 2: Read environment variables
+	privateKey := os.Getenv("TREASURY_PRIVATE_KEY")
 
 	address, err := fetchKaspaAccountFromPrivateKey(config.Network, privateKey)
 	if err != nil {
@@ -142,90 +336,245 @@ func main() {
 		return
 	}
 
-	rpcUrl := "kaspad:16110"
-	if config.Network == "testnet-10" {	
-		rpcUrl = "kaspad:16210"
-	} else if config.Network == "testnet-11" {
-		rpcUrl = "kaspad:16310"
-	}
+	clk := realClock{}
 
-	ksApi, err := NewKaspaAPI(rpcUrl, time.Duration(num)*time.Second)
+	blockWaitTime := time.Duration(num) * time.Second
+	nodes := config.nodeAddresses()
+	pool, err := newNodePool(nodes, blockWaitTime, config.Selection, clk)
 	if err != nil {
 		log.Fatalf("failed to initialize Kaspa API: %v", err)
 	}
 
-	var templateMutex sync.Mutex
-	var currentTemplate *appmessage.GetBlockTemplateResponseMessage
+	publisher := NewTemplatePublisher(rdb, config.RedisChannel, config.PublishEnvelope, clk)
+	publisher.SetMinSubscribers(config.MinSubscribers)
+	publisher.SetChunking(config.Chunking)
+	staleness := newStalenessEstimator(config.Staleness)
+	publisher.SetStaleness(staleness)
+	metrics.Register(staleness.writeMetrics)
+	publisher.Register()
+	metrics.Register(build.writeMetrics)
+	status.Register("build", func() interface{} { return build })
+	var channels []*TemplatePublisher
+	for _, channelConfig := range config.Channels {
+		if !channelConfig.Enabled {
+			continue
+		}
+		channel := NewChannelPublisher(rdb, channelConfig, clk)
+		channel.SetStaleness(staleness)
+		channel.Register()
+		channels = append(channels, channel)
+	}
+
+	selector := newTemplateSelector(config.Selection, nodes, clk)
+	metrics.Register(selector.writeMetrics)
+	status.Register("nodes", selector.statusSection)
 
-	// Start a goroutine to continuously fetch block templates and publish them to Redis
-	go func() {
-		for {
-			template, err := ksApi.GetBlockTemplate(address)
-			if err != nil {
-				log.Printf("error fetching block template: %v", err)
-				time.Sleep(ksApi.blockWaitTime)
-				continue
-			}
+	// One canary per channel the fetcher publishes on
+	var canaries []*DeliveryCanary
+	startCanary := func(canary *DeliveryCanary) *DeliveryCanary {
+		canary.Start(ctx, rdb)
+		canaries = append(canaries, canary)
+		return canary
+	}
+	if config.Canary.Enabled {
+		publisher.SetCanary(startCanary(NewDeliveryCanary(config.RedisChannel, config.Canary, clk)))
+		for _, channel := range channels {
+			channel.SetCanary(startCanary(NewChannelCanary(channel.profile, config.Canary, clk)))
+		}
+	}
 
-			// Safely store the template
-			templateMutex.Lock()
-			currentTemplate = template
-			templateMutex.Unlock()
+	var registry *InstanceRegistry
+	if config.Registry.Enabled {
+		registry = NewInstanceRegistry(rdb, config.Registry, config.Network, address, config.RedisChannel, clk)
+		status.Register("registry", registry.statusSection)
+		go registry.Run(ctx)
+	}
 
-			// Serialize the template to JSON
-			templateJSON, err := json.Marshal(template)
-			if err != nil {
-				log.Printf("error serializing template to JSON: %v", err)
-				continue
-			}
+	var archive *TemplateArchive
+	if config.Archive.Path != "" {
+		archive, err = NewTemplateArchive(config.Archive, clk)
+		if err != nil {
+			log.Fatalf("failed to open template archive: %v", err)
+		}
+		archive.Start()
+	}
 
-			// Publish the JSON to Redis
-			err = rdb.Publish(ctx, config.RedisChannel, templateJSON).Err()
-			if err != nil {
-				log.Printf("error publishing to Redis: %v", err)
-			} else {
-				log.Printf("template published to Redis channel %s", config.RedisChannel)
-			}
+	var history *TemplateHistory
+	if config.History.RecordPath != "" || config.History.RedisStream != "" {
+		history, err = NewTemplateHistory(config.History, rdb)
+		if err != nil {
+			log.Fatalf("failed to open template history: %v", err)
+		}
+	}
 
-			time.Sleep(ksApi.blockWaitTime)
+	var events *DAGEvents
+	if config.Events.RedisStream != "" {
+		if config.Events.Node == "" {
+			config.Events.Node = nodes[0]
+		}
+		events, err = NewDAGEvents(rdb, config.Events, clk)
+		if err != nil {
+			log.Fatalf("failed to set up DAG events: %v", err)
+		}
+		if err := events.Start(ctx); err != nil {
+			log.Fatalf("failed to subscribe to DAG events: %v", err)
 		}
-	}()
+	}
+
+	var assembler *blockAssembler
+	if config.Assembly.Enabled {
+		assembler, err = newBlockAssembler(config.Assembly, config.Network, rdb)
+		if err != nil {
+			log.Fatalf("failed to set up block assembly: %v", err)
+		}
+		metrics.Register(assembler.writeMetrics)
+		status.Register("assembly", assembler.statusSection)
+	}
+
+	var differ *TemplateDiffer
+	if config.Diff.RedisChannel != "" {
+		differ = NewTemplateDiffer(rdb, config.Diff)
+		if config.Canary.Enabled {
+			differ.SetCanary(startCanary(NewDiffCanary(config.Diff.RedisChannel, config.Canary, clk)))
+		}
+	}
+
+	cache := &templateCache{}
+	store := newTemplateStore(config.Persist, rdb)
+	if store != nil {
+		if err := restoreTemplate(ctx, store, cache, publisher); err != nil {
+			log.Printf("%v", err)
+		} else if template, restored := cache.Get(); template != nil && restored {
+			log.Printf("restored last template (DAA score %d)", template.Block.Header.DAAScore)
+		}
+	}
+
+	if config.HTTPListen != "" {
+		httpMux.Handle("/template", cache)
+		httpMux.HandleFunc("/ready", cache.serveReady)
+		startHTTPServer(config.HTTPListen)
+	}
+
+	fetcher := &templateFetcher{
+		clock:     clk,
+		config:    config,
+		rdb:       rdb,
+		address:   address,
+		pool:      pool,
+		selector:  selector,
+		publisher: publisher,
+		channels:  channels,
+		cache:     cache,
+		state:     newLoopState(clk),
+		errors:    newErrorLog(50, clk),
+		registry:  registry,
+		assembler: assembler,
+		differ:    differ,
+		archive:   archive,
+		history:   history,
+		store:     store,
+	}
+	var requests *TemplateRequests
+	if config.Requests.RedisList != "" {
+		fetch := func() (*TemplateEnvelope, error) {
+			return fetcher.fetchAndPublish(ctx)
+		}
+		requests = NewTemplateRequests(rdb, config.Requests, fetch, cache.Envelope, clk)
+		go requests.Run(ctx)
+	}
+
+	scheduler := newPollScheduler(blockWaitTime, config.Polling, clk)
+	metrics.Register(scheduler.writeMetrics)
+	fetcher.scheduler = scheduler
+
+	health := newFetcherHealth(clk)
+	fetcher.health = health
+	fetcher.notifier = newSystemdNotifier()
+	status.Register("node", func() interface{} { return health.Snapshot() })
+	if config.Heartbeat.IntervalMs > 0 {
+		heartbeats := newHeartbeats(rdb, config.Heartbeat, config.RedisChannel, publisher, health, clk)
+		// Heartbeats on the template channel are ignored by its canary
+		if config.Canary.Enabled && config.Heartbeat.RedisChannel != "" {
+			heartbeats.canary = startCanary(NewHeartbeatCanary(config.Heartbeat.RedisChannel, config.Canary, clk))
+		}
+		go heartbeats.Run(ctx)
+	}
+
+	notifiers, err := newAlertNotifiers(config.Alerts.Notifiers, rdb)
+	if err != nil {
+		log.Fatalf("failed to configure alerts: %v", err)
+	}
+	expectedScript, err := addressScript(config.Network, address)
+	if err != nil {
+		log.Fatalf("failed to build treasury script: %v", err)
+	}
+	alerts := NewAlertEngine(config.Alerts, notifiers, clk)
+	addFetcherAlertRules(alerts, config.Alerts, rdb, publisher, health, cache, expectedScript)
+	status.Register("alerts", alerts.statusSection)
+	go alerts.Run(ctx)
+
+	if config.AdminListen != "" {
+		fetcher.registerDebugState(debugState)
+		debugState.Register("queues", func() interface{} {
+			queues := make(map[string]interface{})
+			if archive != nil {
+				queues["archive"] = archive.QueueDepth()
+			}
+			if len(canaries) > 0 {
+				pending := make(map[string]int, len(canaries))
+				for _, canary := range canaries {
+					pending[canary.channel] = canary.Pending()
+				}
+				queues["canary_pending"] = pending
+			}
+			if requests != nil {
+				queues["requests"] = requests.Depth(ctx)
+			}
+			if events != nil {
+				queues["events"] = events.QueueDepth()
+			}
+			return queues
+		})
+		startAdminServer(config.AdminListen)
+	}
+
+	// Start a goroutine to continuously fetch block templates and publish them to Redis
+	go fetcher.run(ctx)
 
 	// Output block template in the main function
 	for {
 		time.Sleep(5 * time.Second) // Adjust the frequency of logging as needed
 
-		templateMutex.Lock()
+		currentTemplate, _ := cache.Get()
 		if currentTemplate != nil {
-// 			fmt.Printf(`
-// HashMerkleRoot        : %v
-// AcceptedIDMerkleRoot  : %v
-// UTXOCommitment        : %v
-// Timestamp             : %v
-// Bits                  : %v
-// Nonce                 : %v
-// DAAScore              : %v
-// BlueWork              : %v
-// BlueScore             : %v
-// PruningPoint          : %v
-// Transactions Length   : %v
-// ---------------------------------------
-// `,
-// 				currentTemplate.Block.Header.HashMerkleRoot,
-// 				currentTemplate.Block.Header.AcceptedIDMerkleRoot,
-// 				currentTemplate.Block.Header.UTXOCommitment,
-// 				currentTemplate.Block.Header.Timestamp,
-// 				currentTemplate.Block.Header.Bits,
-// 				currentTemplate.Block.Header.Nonce,
-// 				currentTemplate.Block.Header.DAAScore,
-// 				currentTemplate.Block.Header.BlueWork,
-// 				currentTemplate.Block.Header.BlueScore,
-// 				currentTemplate.Block.Header.PruningPoint,
-// 				len(currentTemplate.Block.Transactions),
-// 			)
+			// 			fmt.Printf(`
+			// HashMerkleRoot        : %v
+			// AcceptedIDMerkleRoot  : %v
+			// UTXOCommitment        : %v
+			// Timestamp             : %v
+			// Bits                  : %v
+			// Nonce                 : %v
+			// DAAScore              : %v
+			// BlueWork              : %v
+			// BlueScore             : %v
+			// PruningPoint          : %v
+			// Transactions Length   : %v
+			// ---------------------------------------
+			// `,
+			// 				currentTemplate.Block.Header.HashMerkleRoot,
+			// 				currentTemplate.Block.Header.AcceptedIDMerkleRoot,
+			// 				currentTemplate.Block.Header.UTXOCommitment,
+			// 				currentTemplate.Block.Header.Timestamp,
+			// 				currentTemplate.Block.Header.Bits,
+			// 				currentTemplate.Block.Header.Nonce,
+			// 				currentTemplate.Block.Header.DAAScore,
+			// 				currentTemplate.Block.Header.BlueWork,
+			// 				currentTemplate.Block.Header.BlueScore,
+			// 				currentTemplate.Block.Header.PruningPoint,
+			// 				len(currentTemplate.Block.Transactions),
+			// 			)
 		} else {
 			fmt.Println("No block template fetched yet.")
 		}
-		templateMutex.Unlock()
 	}
 }
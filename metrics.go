@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// metricsRegistry collects writers that render metrics in the Prometheus
+// text exposition format. Each component registers a writer for its own
+// metrics instead of sharing global counters.
+type metricsRegistry struct {
+	mutex   sync.Mutex
+	writers []func(w io.Writer)
+}
+
+var metrics = &metricsRegistry{}
+
+func (m *metricsRegistry) Register(writer func(w io.Writer)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.writers = append(m.writers, writer)
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	writers := append([]func(w io.Writer){}, m.writers...)
+	m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, writer := range writers {
+		writer(w)
+	}
+}
+
+// httpMux is shared by every component serving HTTP, handlers must be added
+// before startHTTPServer is called.
+var httpMux = http.NewServeMux()
+
+// startHTTPServer serves the metrics and status endpoints along with any
+// handlers already added to httpMux.
+func startHTTPServer(address string) {
+	httpMux.Handle("/metrics", metrics)
+	httpMux.Handle("/status", status)
+	go func() {
+		log.Printf("serving metrics and status on %s", address)
+		if err := http.ListenAndServe(address, httpMux); err != nil {
+			log.Printf("http server stopped: %v", err)
+		}
+	}()
+}
+
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// WritePrometheus writes the histogram series. labels is either empty or a
+// comma terminated list such as `channel="x",`.
+func (h *histogram) WritePrometheus(w io.Writer, name, labels string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, trimLabels(labels), h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, trimLabels(labels), h.count)
+}
+
+func trimLabels(labels string) string {
+	if len(labels) > 0 && labels[len(labels)-1] == ',' {
+		return labels[:len(labels)-1]
+	}
+	return labels
+}
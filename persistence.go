@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type PersistConfig struct {
+	Path     string `json:"path"`
+	RedisKey string `json:"redis_key"`
+}
+
+// templateStore keeps the last published envelope somewhere that survives a
+// fetcher restart.
+type templateStore interface {
+	Save(ctx context.Context, envelope *TemplateEnvelope) error
+	Load(ctx context.Context) (*TemplateEnvelope, error)
+}
+
+func newTemplateStore(config PersistConfig, rdb *redis.Client) templateStore {
+	if config.Path != "" {
+		return &fileTemplateStore{path: config.Path}
+	}
+	if config.RedisKey != "" {
+		return &redisTemplateStore{rdb: rdb, key: config.RedisKey}
+	}
+	return nil
+}
+
+type fileTemplateStore struct {
+	path string
+}
+
+func (s *fileTemplateStore) Save(ctx context.Context, envelope *TemplateEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	// Write next to the target and rename so a crash never leaves a torn file
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".template-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileTemplateStore) Load(ctx context.Context) (*TemplateEnvelope, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var envelope TemplateEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+type redisTemplateStore struct {
+	rdb *redis.Client
+	key string
+}
+
+func (s *redisTemplateStore) Save(ctx context.Context, envelope *TemplateEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, s.key, data, 0).Err()
+}
+
+func (s *redisTemplateStore) Load(ctx context.Context) (*TemplateEnvelope, error) {
+	data, err := s.rdb.Get(ctx, s.key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var envelope TemplateEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// templateCache holds the envelope of the last published template. A template
+// restored from the store is flagged until the first fresh publish replaces it.
+type templateCache struct {
+	mutex    sync.Mutex
+	envelope *TemplateEnvelope
+	restored bool
+}
+
+// Set records a successfully published envelope.
+func (c *templateCache) Set(envelope *TemplateEnvelope) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.envelope = envelope
+	c.restored = false
+}
+
+func (c *templateCache) Restore(envelope *TemplateEnvelope) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.envelope = envelope
+	c.restored = true
+}
+
+// Envelope returns the last published or restored envelope.
+func (c *templateCache) Envelope() *TemplateEnvelope {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.envelope
+}
+
+func (c *templateCache) Get() (*appmessage.GetBlockTemplateResponseMessage, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.envelope == nil {
+		return nil, false
+	}
+	return c.envelope.Template, c.restored
+}
+
+// ServeHTTP returns the last published envelope, which carries the template.
+func (c *templateCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.envelope == nil {
+		http.Error(w, "no block template fetched yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"restored": c.restored,
+		"envelope": c.envelope,
+	})
+}
+
+func (c *templateCache) serveReady(w http.ResponseWriter, r *http.Request) {
+	if template, _ := c.Get(); template == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func restoreTemplate(ctx context.Context, store templateStore, cache *templateCache, publisher *TemplatePublisher) error {
+	envelope, err := store.Load(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed restoring last template")
+	}
+	if envelope == nil || envelope.Template == nil {
+		return nil
+	}
+	cache.Restore(envelope)
+	publisher.RestoreSequence(envelope.Sequence)
+	return nil
+}
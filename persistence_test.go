@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+func TestFileTemplateStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &fileTemplateStore{path: filepath.Join(dir, "template.json")}
+	ctx := context.Background()
+
+	if envelope, err := store.Load(ctx); envelope != nil || err != nil {
+		t.Fatalf("expected nothing from a missing file, got %+v, %v", envelope, err)
+	}
+
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	for sequence := uint64(1); sequence <= 2; sequence++ {
+		saved := &TemplateEnvelope{Type: messageTypeTemplate, Sequence: sequence,
+			Fingerprint: templateFingerprint(template), Template: template}
+		if err := store.Save(ctx, saved); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := store.Load(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Sequence != sequence || loaded.Fingerprint != saved.Fingerprint ||
+			templateFingerprint(loaded.Template) != saved.Fingerprint {
+			t.Fatalf("store round trip changed the envelope: %+v", loaded)
+		}
+	}
+	// The temporary file is renamed over the target, not left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "template.json" {
+		t.Fatalf("expected only the template file, found %d entries", len(entries))
+	}
+
+	if err := os.WriteFile(store.path, []byte(`{"sequence": 3, "templ`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(ctx); err == nil {
+		t.Fatal("expected an error loading a torn file")
+	}
+
+	missingDir := &fileTemplateStore{path: filepath.Join(dir, "missing", "template.json")}
+	if err := missingDir.Save(ctx, &TemplateEnvelope{Template: template}); err == nil {
+		t.Fatal("expected an error saving to a missing directory")
+	}
+}
+
+func TestRestoreTemplate(t *testing.T) {
+	ctx := context.Background()
+	clk := newFakeClock()
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	store := &fileTemplateStore{path: filepath.Join(t.TempDir(), "template.json")}
+	cache := &templateCache{}
+	publisher := NewTemplatePublisher(nil, "templates", true, clk)
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		return 1, nil
+	}
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		cache.serveReady(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return recorder.Code
+	}
+
+	// Nothing persisted yet
+	if err := restoreTemplate(ctx, store, cache, publisher); err != nil {
+		t.Fatal(err)
+	}
+	if ready() != http.StatusServiceUnavailable {
+		t.Fatal("ready without a template")
+	}
+
+	persisted := &TemplateEnvelope{Type: messageTypeTemplate, Sequence: 41, Template: template}
+	if err := store.Save(ctx, persisted); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTemplate(ctx, store, cache, publisher); err != nil {
+		t.Fatal(err)
+	}
+	if restoredTemplate, restored := cache.Get(); !restored || templateFingerprint(restoredTemplate) != templateFingerprint(template) {
+		t.Fatal("persisted template not restored into the cache")
+	}
+	if ready() != http.StatusOK {
+		t.Fatal("not ready with a restored template")
+	}
+
+	envelope, err := publisher.Publish(ctx, template, clk.Now(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Sequence != 42 {
+		t.Fatalf("expected numbering to continue at 42, got %d", envelope.Sequence)
+	}
+	cache.Set(envelope)
+	if _, restored := cache.Get(); restored {
+		t.Fatal("published template still flagged as restored")
+	}
+}
+
+func TestRestoreTemplateStoreFailure(t *testing.T) {
+	// Nothing listens on port 1, so the Redis store cannot load
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer rdb.Close()
+	store := newTemplateStore(PersistConfig{RedisKey: "template"}, rdb)
+	cache := &templateCache{}
+	publisher := NewTemplatePublisher(nil, "templates", true, newFakeClock())
+	if err := restoreTemplate(context.Background(), store, cache, publisher); err == nil {
+		t.Fatal("expected the store error")
+	}
+	if template, _ := cache.Get(); template != nil {
+		t.Fatal("cache filled despite the store error")
+	}
+	if sequence, _ := publisher.Last(); sequence != 0 {
+		t.Fatalf("sequence moved to %d despite the store error", sequence)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const messageTypeTemplate = "template"
+
+// TemplateEnvelope wraps a published template with the metadata consumers
+// need to order messages and decide whether to drop their current jobs.
+// Consumers should discard the template once the DAA score passes
+// ExpiresAtDAAScore or the clock passes ExpiresAt (unix ms), whichever comes
+// first.
+type TemplateEnvelope struct {
+	Type              string                                      `json:"type"`
+	Sequence          uint64                                      `json:"sequence"`
+	Fingerprint       string                                      `json:"fingerprint"`
+	CleanJobs         bool                                        `json:"clean_jobs"`
+	FetchedAt         int64                                       `json:"fetched_at"`
+	PublishedAt       int64                                       `json:"published_at"`
+	ExpiresAtDAAScore uint64                                      `json:"expires_at_daa_score,omitempty"`
+	ExpiresAt         int64                                       `json:"expires_at,omitempty"`
+	Selection         *nodeSelection                              `json:"selection,omitempty"`
+	Assembly          *assemblyReport                             `json:"assembly,omitempty"`
+	Build             string                                      `json:"build"`
+	Template          *appmessage.GetBlockTemplateResponseMessage `json:"template"`
+}
+
+type TemplatePublisher struct {
+	rdb       *redis.Client
+	clock     clock
+	channel   string
+	envelope  bool
+	canary    *DeliveryCanary
+	staleness *stalenessEstimator
+	profile   ChannelConfig
+	chunking  ChunkingConfig
+	// send publishes the messages of one template, replaced in tests
+	send func(ctx context.Context, messages [][]byte) (int64, error)
+
+	// minSubscribers is the number of consumers expected on the channel,
+	// the canary's own subscription is not counted.
+	minSubscribers int64
+
+	mutex           sync.Mutex
+	sequence        uint64
+	lastFingerprint string
+	lastParents     string
+	subscribers     int64
+	subscribersLow  bool
+	lastPublishedAt time.Time
+	skipped         uint64
+}
+
+func NewTemplatePublisher(rdb *redis.Client, channel string, envelope bool, clk clock) *TemplatePublisher {
+	p := &TemplatePublisher{
+		rdb:      rdb,
+		clock:    clk,
+		channel:  channel,
+		envelope: envelope,
+	}
+	p.send = p.publishMessages
+	return p
+}
+
+// Register exposes the publisher's channel state in metrics and status.
+func (p *TemplatePublisher) Register() {
+	metrics.Register(p.writeMetrics)
+	status.Register("publisher:"+p.channel, p.statusSection)
+}
+
+// SetCanary makes the publisher announce every message to the canary
+// subscribed on its channel.
+func (p *TemplatePublisher) SetCanary(canary *DeliveryCanary) {
+	p.canary = canary
+}
+
+// SetStaleness makes the publisher stamp envelopes with an expiry hint.
+func (p *TemplatePublisher) SetStaleness(staleness *stalenessEstimator) {
+	p.staleness = staleness
+}
+
+// SetChunking makes the publisher split payloads above a size threshold.
+func (p *TemplatePublisher) SetChunking(chunking ChunkingConfig) {
+	p.chunking = chunking
+}
+
+// SetMinSubscribers sets the consumer count below which an alert is raised.
+func (p *TemplatePublisher) SetMinSubscribers(minSubscribers int64) {
+	p.minSubscribers = minSubscribers
+}
+
+// RestoreSequence continues numbering from a sequence persisted by a
+// previous run, so consumers never see the sequence go backwards.
+func (p *TemplatePublisher) RestoreSequence(sequence uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if sequence > p.sequence {
+		p.sequence = sequence
+	}
+}
+
+// Last returns the sequence and fingerprint of the last published message.
+func (p *TemplatePublisher) Last() (uint64, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sequence, p.lastFingerprint
+}
+
+// Subscribers returns the number of consumers that received the last message.
+func (p *TemplatePublisher) Subscribers() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.subscribers
+}
+
+func (p *TemplatePublisher) trackSubscribers(receivers int64) {
+	// Until Redis confirms the canary's subscription it may not have
+	// received the message
+	if p.canary != nil && p.canary.Subscribed() && receivers > 0 {
+		receivers--
+	}
+	p.subscribers = receivers
+
+	p.subscribersLow = receivers == 0 || receivers < p.minSubscribers
+}
+
+// SubscribersLow reports whether the last message reached fewer consumers
+// than expected, along with how many it reached.
+func (p *TemplatePublisher) SubscribersLow() (bool, int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.subscribersLow, p.subscribers
+}
+
+func (p *TemplatePublisher) writeMetrics(w io.Writer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	fmt.Fprintf(w, "katpool_channel_subscribers{channel=%q} %d\n", p.channel, p.subscribers)
+	fmt.Fprintf(w, "katpool_channel_sequence{channel=%q} %d\n", p.channel, p.sequence)
+	fmt.Fprintf(w, "katpool_channel_skipped_total{channel=%q} %d\n", p.channel, p.skipped)
+}
+
+func (p *TemplatePublisher) statusSection() interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return map[string]interface{}{
+		"channel":         p.channel,
+		"sequence":        p.sequence,
+		"subscribers":     p.subscribers,
+		"min_subscribers": p.minSubscribers,
+	}
+}
+
+// fingerprintLength is the length of a template fingerprint in hex characters.
+const fingerprintLength = 2 * 16
+
+// templateFingerprint identifies a template by the hash of its header.
+func templateFingerprint(template *appmessage.GetBlockTemplateResponseMessage) string {
+	if template.Block == nil || template.Block.Header == nil {
+		return ""
+	}
+	headerJSON, err := json.Marshal(template.Block.Header)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(headerJSON)
+	return hex.EncodeToString(sum[:fingerprintLength/2])
+}
+
+func parentsKey(template *appmessage.GetBlockTemplateResponseMessage) string {
+	if template.Block == nil || template.Block.Header == nil || len(template.Block.Header.Parents) == 0 {
+		return ""
+	}
+	return strings.Join(template.Block.Header.Parents[0].ParentHashes, ",")
+}
+
+// Publish serializes the template and publishes it to the configured channel.
+// Sequence numbers are only consumed by successfully published messages, and
+// clean_jobs is set whenever the template's parents differ from the last one.
+// A nil envelope is returned when the channel's profile skips the template.
+func (p *TemplatePublisher) Publish(ctx context.Context, template *appmessage.GetBlockTemplateResponseMessage,
+	fetchedAt time.Time, selection *nodeSelection, assembly *assemblyReport) (*TemplateEnvelope, error) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	parents := parentsKey(template)
+	envelope := &TemplateEnvelope{
+		Type:        messageTypeTemplate,
+		Sequence:    p.sequence + 1,
+		Fingerprint: templateFingerprint(template),
+		CleanJobs:   parents != p.lastParents,
+		FetchedAt:   fetchedAt.UnixMilli(),
+		PublishedAt: now.UnixMilli(),
+		Selection:   selection,
+		Assembly:    assembly,
+		Build:       currentBuild().Short(),
+		Template:    template,
+	}
+	if p.staleness != nil {
+		p.staleness.Observe(template.Block.Header.DAAScore, fetchedAt)
+		envelope.ExpiresAtDAAScore, envelope.ExpiresAt = p.staleness.Expiry(template)
+	}
+
+	if p.skip(envelope.CleanJobs, now) {
+		p.skipped++
+		return nil, nil
+	}
+	payload, err := p.encode(envelope)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := p.chunk(payload, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.canary != nil {
+		p.canary.Expect(envelope)
+	}
+	receivers, err := p.send(ctx, messages)
+	if err != nil {
+		if p.canary != nil {
+			p.canary.Cancel(envelope)
+		}
+		return nil, errors.Wrap(err, "error publishing to Redis")
+	}
+
+	p.trackSubscribers(receivers)
+	p.sequence = envelope.Sequence
+	p.lastFingerprint = envelope.Fingerprint
+	p.lastParents = parents
+	p.lastPublishedAt = now
+	return envelope, nil
+}
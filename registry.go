@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type RegistryConfig struct {
+	Enabled          bool   `json:"enabled"`
+	KeyPrefix        string `json:"key_prefix"`
+	IntervalMs       int64  `json:"interval_ms"`
+	RefuseOnConflict bool   `json:"refuse_on_conflict"`
+}
+
+type instanceInfo struct {
+	InstanceID  string `json:"instance_id"`
+	Version     string `json:"version"`
+	Network     string `json:"network"`
+	AddressHash string `json:"address_hash"`
+	Channel     string `json:"channel"`
+	StartedAt   int64  `json:"started_at"`
+}
+
+// conflictsWith reports why two instances on the same channel must not run
+// together, or "" if they are merely duplicates.
+func (i *instanceInfo) conflictsWith(other *instanceInfo) string {
+	if i.Network != other.Network {
+		return fmt.Sprintf("network %s != %s", other.Network, i.Network)
+	}
+	if i.AddressHash != other.AddressHash {
+		return "different treasury address"
+	}
+	return ""
+}
+
+// outranks reports whether i keeps publishing when it conflicts with other:
+// the instance started first wins, ties go to the lowest instance ID.
+func (i *instanceInfo) outranks(other *instanceInfo) bool {
+	if i.StartedAt != other.StartedAt {
+		return i.StartedAt < other.StartedAt
+	}
+	return i.InstanceID < other.InstanceID
+}
+
+// InstanceRegistry announces this fetcher under a per-channel key with a TTL
+// and watches the other instances registered on the same channel.
+type InstanceRegistry struct {
+	clock    clock
+	rdb      *redis.Client
+	self     instanceInfo
+	prefix   string
+	interval time.Duration
+
+	mutex    sync.Mutex
+	conflict string
+}
+
+func NewInstanceRegistry(rdb *redis.Client, config RegistryConfig, network, address, channel string,
+	clk clock) *InstanceRegistry {
+
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = "BlockTemplateFetcher:"
+	}
+	if config.IntervalMs == 0 {
+		config.IntervalMs = 5000
+	}
+	addressHash := sha256.Sum256([]byte(address))
+	return &InstanceRegistry{
+		clock: clk,
+		rdb:   rdb,
+		self: instanceInfo{
+			InstanceID:  newInstanceID(),
+			Version:     currentBuild().Short(),
+			Network:     network,
+			AddressHash: hex.EncodeToString(addressHash[:8]),
+			Channel:     channel,
+			StartedAt:   clk.Now().UnixMilli(),
+		},
+		prefix:   config.KeyPrefix + channel + ":",
+		interval: time.Duration(config.IntervalMs) * time.Millisecond,
+	}
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats as a pattern, so a
+// channel name like "templates[1]" only matches itself.
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+func (r *InstanceRegistry) Run(ctx context.Context) {
+	log.Printf("registered as instance %s on %s", r.self.InstanceID, r.self.Channel)
+	tick, stop := r.clock.Tick(r.interval)
+	defer stop()
+	for {
+		if err := r.refresh(ctx); err != nil {
+			log.Printf("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			r.rdb.Del(context.Background(), r.prefix+r.self.InstanceID)
+			return
+		case <-tick:
+		}
+	}
+}
+
+func (r *InstanceRegistry) refresh(ctx context.Context) error {
+	data, err := json.Marshal(&r.self)
+	if err != nil {
+		return err
+	}
+	// Expire after a few missed refreshes so crashed instances drop out
+	if err := r.rdb.Set(ctx, r.prefix+r.self.InstanceID, data, 3*r.interval).Err(); err != nil {
+		return errors.Wrap(err, "error refreshing instance registration")
+	}
+
+	var others []instanceInfo
+	iter := r.rdb.Scan(ctx, 0, escapeGlob(r.prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		value, err := r.rdb.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			continue
+		}
+		var other instanceInfo
+		if err := json.Unmarshal(value, &other); err != nil {
+			continue
+		}
+		others = append(others, other)
+	}
+	if err := iter.Err(); err != nil {
+		return errors.Wrap(err, "error listing registered instances")
+	}
+	r.evaluate(others)
+	return nil
+}
+
+// evaluate updates the conflict state from the instances registered on the
+// channel. Of two conflicting instances only the outranked one refuses to
+// publish, so they never both stop.
+func (r *InstanceRegistry) evaluate(others []instanceInfo) {
+	var conflict string
+	for i := range others {
+		other := &others[i]
+		if other.InstanceID == r.self.InstanceID {
+			continue
+		}
+		reason := r.self.conflictsWith(other)
+		switch {
+		case reason == "":
+			log.Printf("WARNING duplicate fetcher %s also publishes on %s", other.InstanceID, other.Channel)
+		case r.self.outranks(other):
+			log.Printf("ALERT conflicting fetcher %s publishes on %s with %s, this instance started first and keeps publishing",
+				other.InstanceID, other.Channel, reason)
+		default:
+			conflict = fmt.Sprintf("instance %s (version %s) publishes on %s with %s",
+				other.InstanceID, other.Version, other.Channel, reason)
+			log.Printf("ALERT conflicting fetcher: %s", conflict)
+		}
+	}
+
+	r.mutex.Lock()
+	r.conflict = conflict
+	r.mutex.Unlock()
+}
+
+// Conflict returns an error while a conflicting instance is registered.
+func (r *InstanceRegistry) Conflict() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.conflict == "" {
+		return nil
+	}
+	return errors.Errorf("refusing to publish, conflicting %s", r.conflict)
+}
+
+func (r *InstanceRegistry) statusSection() interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return map[string]interface{}{
+		"instance": r.self,
+		"conflict": r.conflict,
+	}
+}
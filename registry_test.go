@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestInstanceRegistryConflictTieBreak(t *testing.T) {
+	newRegistry := func(id string, startedAt int64, network string) *InstanceRegistry {
+		return &InstanceRegistry{self: instanceInfo{
+			InstanceID: id, Network: network, AddressHash: "treasury", Channel: "templates", StartedAt: startedAt,
+		}}
+	}
+	refusing := func(a, b *InstanceRegistry) (bool, bool) {
+		others := []instanceInfo{a.self, b.self}
+		a.evaluate(others)
+		b.evaluate(others)
+		return a.Conflict() != nil, b.Conflict() != nil
+	}
+
+	older, newer := newRegistry("b", 1000, "mainnet"), newRegistry("a", 2000, "testnet-10")
+	if olderRefuses, newerRefuses := refusing(older, newer); olderRefuses || !newerRefuses {
+		t.Fatalf("expected only the newer instance to refuse, older %v newer %v", olderRefuses, newerRefuses)
+	}
+
+	low, high := newRegistry("a", 1000, "mainnet"), newRegistry("b", 1000, "testnet-10")
+	if lowRefuses, highRefuses := refusing(low, high); lowRefuses || !highRefuses {
+		t.Fatalf("expected only the higher instance ID to refuse, low %v high %v", lowRefuses, highRefuses)
+	}
+
+	first, duplicate := newRegistry("a", 1000, "mainnet"), newRegistry("b", 2000, "mainnet")
+	if firstRefuses, duplicateRefuses := refusing(first, duplicate); firstRefuses || duplicateRefuses {
+		t.Fatalf("duplicates must not refuse, first %v duplicate %v", firstRefuses, duplicateRefuses)
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if escaped := escapeGlob(`BlockTemplateFetcher:t*[1]?\:`); escaped != `BlockTemplateFetcher:t\*\[1\]\?\\:` {
+		t.Fatalf("unexpected escaping %s", escaped)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/context"
+)
+
+type RequestConfig struct {
+	RedisList       string `json:"redis_list"`
+	ReplyPrefix     string `json:"reply_prefix"`
+	MinIntervalMs   int64  `json:"min_interval_ms"`
+	ReplyTTLSeconds int64  `json:"reply_ttl_seconds"`
+}
+
+// maxCoalescedRequests bounds how many queued request IDs share one fetch.
+const maxCoalescedRequests = 100
+
+type templateReply struct {
+	RequestID string            `json:"request_id"`
+	Envelope  *TemplateEnvelope `json:"envelope,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// TemplateRequests serves on-demand template requests. Clients LPUSH a request
+// ID onto the request list and BLPOP the reply from ReplyPrefix+ID. All IDs
+// queued at the time of a fetch are answered by that fetch, and fetches are
+// never closer together than MinIntervalMs; requests arriving sooner get the
+// latest published template, whichever fetch published it.
+type TemplateRequests struct {
+	clock       clock
+	rdb         *redis.Client
+	list        string
+	replyPrefix string
+	minInterval time.Duration
+	replyTTL    time.Duration
+	fetch       func() (*TemplateEnvelope, error)
+	latest      func() *TemplateEnvelope
+	// pop takes the oldest queued request ID, waiting up to timeout for one
+	// unless timeout is zero, and push stores a reply. Both are replaced in
+	// tests.
+	pop  func(ctx context.Context, timeout time.Duration) (string, error)
+	push func(ctx context.Context, key string, payload []byte) error
+}
+
+func NewTemplateRequests(rdb *redis.Client, config RequestConfig, fetch func() (*TemplateEnvelope, error),
+	latest func() *TemplateEnvelope, clk clock) *TemplateRequests {
+
+	if config.ReplyPrefix == "" {
+		config.ReplyPrefix = config.RedisList + ":"
+	}
+	if config.ReplyTTLSeconds == 0 {
+		config.ReplyTTLSeconds = 30
+	}
+	r := &TemplateRequests{
+		clock:       clk,
+		rdb:         rdb,
+		list:        config.RedisList,
+		replyPrefix: config.ReplyPrefix,
+		minInterval: time.Duration(config.MinIntervalMs) * time.Millisecond,
+		replyTTL:    time.Duration(config.ReplyTTLSeconds) * time.Second,
+		fetch:       fetch,
+		latest:      latest,
+	}
+	r.pop = r.popRequest
+	r.push = r.pushReply
+	return r
+}
+
+func (r *TemplateRequests) popRequest(ctx context.Context, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		return r.rdb.RPop(ctx, r.list).Result()
+	}
+	result, err := r.rdb.BRPop(ctx, timeout, r.list).Result()
+	if err != nil {
+		return "", err
+	}
+	return result[1], nil
+}
+
+func (r *TemplateRequests) pushReply(ctx context.Context, key string, payload []byte) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, payload)
+		pipe.Expire(ctx, key, r.replyTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *TemplateRequests) Run(ctx context.Context) {
+	log.Printf("serving on-demand template requests from %s", r.list)
+	for ctx.Err() == nil {
+		requestID, err := r.pop(ctx, 5*time.Second)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Printf("error reading template requests: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-r.clock.After(time.Second):
+			}
+			continue
+		}
+		requestIDs := []string{requestID}
+
+		// Coalesce everything else already queued into the same fetch
+		for len(requestIDs) < maxCoalescedRequests {
+			requestID, err := r.pop(ctx, 0)
+			if err != nil {
+				break
+			}
+			requestIDs = append(requestIDs, requestID)
+		}
+
+		reply := r.serve()
+		for _, requestID := range requestIDs {
+			reply.RequestID = requestID
+			r.reply(ctx, reply)
+		}
+	}
+}
+
+// Depth returns the number of requests waiting in the request list.
+func (r *TemplateRequests) Depth(ctx context.Context) int64 {
+	depth, err := r.rdb.LLen(ctx, r.list).Result()
+	if err != nil {
+		return -1
+	}
+	return depth
+}
+
+// serve answers with the latest published template when it is recent enough,
+// and fetches a new one otherwise.
+func (r *TemplateRequests) serve() templateReply {
+	if latest := r.latest(); latest != nil && r.clock.Now().Sub(time.UnixMilli(latest.PublishedAt)) < r.minInterval {
+		return templateReply{Envelope: latest}
+	}
+	envelope, err := r.fetch()
+	if err != nil {
+		return templateReply{Error: err.Error()}
+	}
+	return templateReply{Envelope: envelope}
+}
+
+func (r *TemplateRequests) reply(ctx context.Context, reply templateReply) {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("error serializing template reply: %v", err)
+		return
+	}
+	if err := r.push(ctx, r.replyPrefix+reply.RequestID, payload); err != nil {
+		log.Printf("error replying to template request %s: %v", reply.RequestID, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"golang.org/x/net/context"
+)
+
+// newTestRequests serves requests from a queue, fetching through a fetcher
+// with a stubbed node, and delivers replies to the returned channel.
+func newTestRequests(t *testing.T, clk *fakeClock, minInterval time.Duration) (*TemplateRequests, *templateFetcher,
+	chan<- string, <-chan templateReply, *int32) {
+
+	generator := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1})
+	var fetches int32
+	fetcher, _ := newTestFetcher(clk, func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		atomic.AddInt32(&fetches, 1)
+		return generator.next(), nil
+	})
+	fetch := func() (*TemplateEnvelope, error) {
+		return fetcher.fetchAndPublish(context.Background())
+	}
+	requests := NewTemplateRequests(nil, RequestConfig{RedisList: "requests", MinIntervalMs: minInterval.Milliseconds()},
+		fetch, fetcher.cache.Envelope, clk)
+
+	queue := make(chan string, 10)
+	requests.pop = func(ctx context.Context, timeout time.Duration) (string, error) {
+		if timeout == 0 {
+			select {
+			case requestID := <-queue:
+				return requestID, nil
+			default:
+				return "", redis.Nil
+			}
+		}
+		select {
+		case requestID := <-queue:
+			return requestID, nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	replies := make(chan templateReply, 10)
+	requests.push = func(ctx context.Context, key string, payload []byte) error {
+		var reply templateReply
+		if err := json.Unmarshal(payload, &reply); err != nil {
+			t.Error(err)
+		}
+		if key != "requests:"+reply.RequestID {
+			t.Errorf("reply %s stored under %s", reply.RequestID, key)
+		}
+		replies <- reply
+		return nil
+	}
+	return requests, fetcher, queue, replies, &fetches
+}
+
+func TestTemplateRequestsCoalesce(t *testing.T) {
+	clk := newFakeClock()
+	requests, fetcher, queue, replies, fetches := newTestRequests(t, clk, 0)
+	for _, requestID := range []string{"a", "b", "c"} {
+		queue <- requestID
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go requests.Run(ctx)
+
+	answered := make(map[string]bool)
+	var sequence uint64
+	for i := 0; i < 3; i++ {
+		reply := <-replies
+		if reply.Error != "" || reply.Envelope == nil {
+			t.Fatalf("unexpected reply %+v", reply)
+		}
+		if sequence != 0 && reply.Envelope.Sequence != sequence {
+			t.Fatalf("queued requests answered by different fetches")
+		}
+		sequence, answered[reply.RequestID] = reply.Envelope.Sequence, true
+	}
+	if len(answered) != 3 || atomic.LoadInt32(fetches) != 1 {
+		t.Fatalf("expected 3 requests answered by 1 fetch, got %d answered by %d", len(answered), atomic.LoadInt32(fetches))
+	}
+	// A request-driven fetch counts for the fetcher's health like a polled one
+	if health := fetcher.health.Snapshot(); !health.Healthy {
+		t.Fatalf("request-driven fetch not recorded in the health state: %+v", health)
+	}
+}
+
+func TestTemplateRequestsMinInterval(t *testing.T) {
+	clk := newFakeClock()
+	requests, fetcher, queue, replies, fetches := newTestRequests(t, clk, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go requests.Run(ctx)
+
+	queue <- "a"
+	first := <-replies
+	if first.Envelope == nil || first.Envelope.Sequence != 1 {
+		t.Fatalf("unexpected first reply %+v", first)
+	}
+
+	// The polling loop publishes a newer template, which a request within
+	// the interval gets instead of the one fetched for the first request
+	clk.Advance(300 * time.Millisecond)
+	polled, err := fetcher.fetchAndPublish(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(300 * time.Millisecond)
+	queue <- "b"
+	if reply := <-replies; reply.Envelope == nil || reply.Envelope.Sequence != polled.Sequence {
+		t.Fatalf("expected the polled template %d, got %+v", polled.Sequence, reply)
+	}
+	if atomic.LoadInt32(fetches) != 2 {
+		t.Fatalf("request within the interval fetched, %d fetches", atomic.LoadInt32(fetches))
+	}
+
+	clk.Advance(time.Second)
+	queue <- "c"
+	if reply := <-replies; reply.Envelope == nil || reply.Envelope.Sequence != polled.Sequence+1 {
+		t.Fatalf("expected a fresh fetch once the interval passed, got %+v", reply)
+	}
+	if atomic.LoadInt32(fetches) != 3 {
+		t.Fatalf("expected 3 fetches, got %d", atomic.LoadInt32(fetches))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type PollingConfig struct {
+	Adaptive      bool  `json:"adaptive"`
+	MinIntervalMs int64 `json:"min_interval_ms"`
+	MaxIntervalMs int64 `json:"max_interval_ms"`
+}
+
+// pollScheduler decides how long the fetch loop sleeps between fetches. With
+// adaptive polling disabled it always returns the base interval. Otherwise
+// the interval follows the observed DAA score rate (two polls per DAA step)
+// while fetches succeed, and backs off exponentially with jitter on
+// consecutive errors, always within [min, max].
+type pollScheduler struct {
+	clock    clock
+	adaptive bool
+	base     time.Duration
+	min      time.Duration
+	max      time.Duration
+	rng      *rand.Rand
+
+	mutex     sync.Mutex
+	interval  time.Duration
+	failures  int
+	lastDAA   uint64
+	lastDAAAt time.Time
+}
+
+func newPollScheduler(base time.Duration, config PollingConfig, clk clock) *pollScheduler {
+	s := &pollScheduler{
+		clock:    clk,
+		adaptive: config.Adaptive,
+		base:     base,
+		min:      time.Duration(config.MinIntervalMs) * time.Millisecond,
+		max:      time.Duration(config.MaxIntervalMs) * time.Millisecond,
+		rng:      rand.New(rand.NewSource(clk.Now().UnixNano())),
+		interval: base,
+	}
+	if s.min == 0 {
+		s.min = 100 * time.Millisecond
+	}
+	if s.max == 0 {
+		s.max = 30 * time.Second
+	}
+	return s
+}
+
+func (s *pollScheduler) clamp(interval time.Duration) time.Duration {
+	if interval < s.min {
+		return s.min
+	}
+	if interval > s.max {
+		return s.max
+	}
+	return interval
+}
+
+func (s *pollScheduler) Success(daaScore uint64, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = 0
+	if !s.adaptive {
+		return
+	}
+
+	switch {
+	case s.lastDAA == 0 || daaScore < s.lastDAA:
+		s.interval = s.clamp(s.base)
+	case daaScore > s.lastDAA:
+		perStep := now.Sub(s.lastDAAAt) / time.Duration(daaScore-s.lastDAA)
+		s.interval = s.clamp(perStep / 2)
+	default:
+		// The DAA score did not move, relax back toward the base interval
+		relaxed := s.interval * 5 / 4
+		if relaxed > s.base {
+			relaxed = s.base
+		}
+		s.interval = s.clamp(relaxed)
+		return
+	}
+	s.lastDAA, s.lastDAAAt = daaScore, now
+}
+
+func (s *pollScheduler) Failure() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures++
+	if !s.adaptive {
+		return
+	}
+
+	backoff := s.base
+	for i := 1; i < s.failures && backoff < s.max; i++ {
+		backoff *= 2
+	}
+	// Jitter between half and the full backoff so fetchers sharing a node do
+	// not retry in lockstep
+	jittered := backoff/2 + time.Duration(s.rng.Int63n(int64(backoff/2)+1))
+	s.interval = s.clamp(jittered)
+}
+
+// Wait returns a channel that fires when the next fetch is due.
+func (s *pollScheduler) Wait() <-chan time.Time {
+	return s.clock.After(s.Next())
+}
+
+func (s *pollScheduler) Next() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.adaptive {
+		return s.base
+	}
+	return s.interval
+}
+
+func (s *pollScheduler) writeMetrics(w io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	interval := s.base
+	if s.adaptive {
+		interval = s.interval
+	}
+	fmt.Fprintf(w, "katpool_poll_interval_seconds %g\n", interval.Seconds())
+	fmt.Fprintf(w, "katpool_poll_consecutive_failures %d\n", s.failures)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdNotifier implements the sd_notify protocol, it is a no-op unless the
+// fetcher runs as a systemd Type=notify service.
+type systemdNotifier struct {
+	socket   string
+	ready    bool
+	watchdog bool
+}
+
+func newSystemdNotifier() *systemdNotifier {
+	n := &systemdNotifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		n.watchdog = true
+		log.Printf("systemd watchdog enabled, timeout %v", time.Duration(usec)*time.Microsecond)
+	}
+	return n
+}
+
+func (n *systemdNotifier) notify(state string) {
+	if n.socket == "" {
+		return
+	}
+	address := &net.UnixAddr{Name: n.socket, Net: "unixgram"}
+	if n.socket[0] == '@' {
+		// Abstract namespace socket
+		address.Name = "\x00" + n.socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, address)
+	if err != nil {
+		log.Printf("error notifying systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("error notifying systemd: %v", err)
+	}
+}
+
+// Success reports a successful fetch. The first one marks the service ready,
+// since the node and Redis have both answered by then.
+func (n *systemdNotifier) Success(envelope *TemplateEnvelope) {
+	state := fmt.Sprintf("STATUS=published template %d (DAA score %d)",
+		envelope.Sequence, envelope.Template.Block.Header.DAAScore)
+	if !n.ready {
+		state = "READY=1\n" + state
+		n.ready = true
+	}
+	n.notify(state)
+}
+
+// Failure reports a failed fetch, node outages included, in the service
+// status.
+func (n *systemdNotifier) Failure(err error) {
+	n.notify(fmt.Sprintf("STATUS=fetch loop failing: %v", err))
+}
+
+// Alive pets the watchdog. The fetch loop calls it on every iteration
+// whatever the outcome, so only a wedged loop gets the process restarted and
+// a node outage does not.
+func (n *systemdNotifier) Alive() {
+	if n.watchdog {
+		n.notify("WATCHDOG=1")
+	}
+}
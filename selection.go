@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+type SelectionConfig struct {
+	Policy string `json:"policy"`
+	// Weights ranks nodes for the preferred policy, nodes without a weight
+	// count as zero and ties go to the node listed first
+	Weights             map[string]float64 `json:"weights"`
+	SwitchMarginPercent float64            `json:"switch_margin_percent"`
+	MinHoldMs           int64              `json:"min_hold_ms"`
+	// NodeTimeoutMs bounds each node's GetBlockTemplate call in a fetch round
+	NodeTimeoutMs int64 `json:"node_timeout_ms"`
+}
+
+const defaultNodeTimeout = 2 * time.Second
+
+const (
+	policyBlueWork  = "blue_work"
+	policyFees      = "fees"
+	policyLatency   = "latency"
+	policyPreferred = "preferred"
+)
+
+// Reasons a node was selected, also used as metric labels.
+const (
+	selectedBest         = "best"
+	selectedOnlyNode     = "only_node"
+	selectedFailover     = "failover"
+	selectedHold         = "hold"
+	selectedWithinMargin = "within_margin"
+)
+
+// nodeSelection records which node a published template came from and why.
+type nodeSelection struct {
+	Node   string `json:"node"`
+	Policy string `json:"policy"`
+	Reason string `json:"reason"`
+}
+
+type nodeResult struct {
+	node     string
+	template *appmessage.GetBlockTemplateResponseMessage
+	latency  time.Duration
+	// fees is the total fee of the template's transactions, only fetched
+	// for the fees policy
+	fees uint64
+	err  error
+}
+
+type poolNode struct {
+	address string
+	fetch   func(miningAddr string) (*appmessage.GetBlockTemplateResponseMessage, error)
+	mempool func() (*appmessage.GetMempoolEntriesResponseMessage, error)
+	// busy is set while a call is in flight, including one that outlived
+	// its round
+	busy int32
+}
+
+// nodePool fetches templates from every configured node in parallel.
+type nodePool struct {
+	clock   clock
+	nodes   []*poolNode
+	timeout time.Duration
+	fees    bool
+}
+
+func newNodePool(addresses []string, blockWaitTime time.Duration, config SelectionConfig, clk clock) (*nodePool, error) {
+	pool := &nodePool{
+		clock:   clk,
+		timeout: time.Duration(config.NodeTimeoutMs) * time.Millisecond,
+		fees:    config.Policy == policyFees,
+	}
+	if pool.timeout <= 0 {
+		pool.timeout = defaultNodeTimeout
+	}
+	for _, address := range addresses {
+		node, err := NewKaspaAPI(address, blockWaitTime)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error connecting to %s", address)
+		}
+		pool.nodes = append(pool.nodes, &poolNode{address: address, fetch: node.GetBlockTemplate, mempool: node.GetMempoolEntries})
+	}
+	return pool, nil
+}
+
+// Fetch returns one result per node, in configuration order. Nodes that do
+// not answer within the timeout count as failed for the round and their late
+// answer is dropped, a node still busy with such a call is not asked again.
+// For the fees policy the node's mempool is fetched after its template.
+func (p *nodePool) Fetch(miningAddr string) []*nodeResult {
+	type indexedResult struct {
+		index  int
+		result *nodeResult
+	}
+	results := make([]*nodeResult, len(p.nodes))
+	done := make(chan indexedResult, len(p.nodes))
+	pending := 0
+	for i, node := range p.nodes {
+		if !atomic.CompareAndSwapInt32(&node.busy, 0, 1) {
+			results[i] = &nodeResult{node: node.address, err: errors.New("previous request still in flight")}
+			continue
+		}
+		pending++
+		go func(i int, node *poolNode) {
+			defer atomic.StoreInt32(&node.busy, 0)
+			start := p.clock.Now()
+			template, err := node.fetch(miningAddr)
+			result := &nodeResult{node: node.address, template: template, latency: p.clock.Now().Sub(start), err: err}
+			if err == nil && p.fees {
+				result.fees, result.err = node.templateFees(template)
+			}
+			done <- indexedResult{i, result}
+		}(i, node)
+	}
+
+	timeout := p.clock.After(p.timeout)
+	for pending > 0 {
+		select {
+		case r := <-done:
+			results[r.index] = r.result
+			pending--
+		case <-timeout:
+			for i, result := range results {
+				if result == nil {
+					results[i] = &nodeResult{node: p.nodes[i].address, latency: p.timeout,
+						err: errors.Errorf("no template within %s", p.timeout)}
+				}
+			}
+			return results
+		}
+	}
+	return results
+}
+
+// Fees sums the fees of template's transactions as listed by the mempool of
+// the node at address.
+func (p *nodePool) Fees(address string, template *appmessage.GetBlockTemplateResponseMessage) (uint64, error) {
+	for _, node := range p.nodes {
+		if node.address == address {
+			return node.templateFees(template)
+		}
+	}
+	return 0, errors.Errorf("unknown node %s", address)
+}
+
+// templateFees sums the fees the node's mempool lists for the template's
+// transactions. A transaction that left the mempool between the two calls
+// counts as paying nothing.
+func (n *poolNode) templateFees(template *appmessage.GetBlockTemplateResponseMessage) (uint64, error) {
+	mempool, err := n.mempool()
+	if err != nil {
+		return 0, err
+	}
+	fees := make(map[string]uint64, len(mempool.Entries))
+	for _, entry := range mempool.Entries {
+		if entry.Transaction != nil && entry.Transaction.VerboseData != nil {
+			fees[entry.Transaction.VerboseData.TransactionID] = entry.Fee
+		}
+	}
+	ids, err := transactionIDs(template)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, id := range ids {
+		total += fees[id]
+	}
+	return total, nil
+}
+
+// templateSelector picks one template out of the results of a fetch round.
+// To avoid flapping it sticks with the current node unless that node failed,
+// or the candidate beats it by the configured margin after the current node
+// has been held for at least the minimum hold time.
+type templateSelector struct {
+	clock   clock
+	policy  string
+	weights map[string]float64
+	margin  float64
+	minHold time.Duration
+
+	mutex      sync.Mutex
+	current    string
+	switchedAt time.Time
+	switches   uint64
+	selected   map[string]map[string]uint64
+	last       map[string]*nodeResult
+	nodes      []string
+}
+
+func newTemplateSelector(config SelectionConfig, nodes []string, clk clock) *templateSelector {
+	s := &templateSelector{
+		clock:    clk,
+		policy:   config.Policy,
+		weights:  config.Weights,
+		margin:   config.SwitchMarginPercent / 100,
+		minHold:  time.Duration(config.MinHoldMs) * time.Millisecond,
+		selected: make(map[string]map[string]uint64),
+		last:     make(map[string]*nodeResult),
+		nodes:    nodes,
+	}
+	if s.policy == "" {
+		s.policy = policyBlueWork
+	}
+	return s
+}
+
+func blueWork(result *nodeResult) *big.Int {
+	work, ok := new(big.Int).SetString(result.template.Block.Header.BlueWork, 16)
+	if !ok {
+		return new(big.Int)
+	}
+	return work
+}
+
+// beats reports whether a is better than b under the policy, by at least
+// margin for the policies with a continuous score.
+func (s *templateSelector) beats(a, b *nodeResult, margin float64) bool {
+	switch s.policy {
+	case policyFees:
+		return float64(a.fees) > float64(b.fees)*(1+margin)
+	case policyLatency:
+		return float64(a.latency) < float64(b.latency)*(1-margin)
+	case policyPreferred:
+		return s.weights[a.node] > s.weights[b.node]
+	default:
+		threshold := new(big.Float).SetInt(blueWork(b))
+		threshold.Mul(threshold, big.NewFloat(1+margin))
+		return new(big.Float).SetInt(blueWork(a)).Cmp(threshold) > 0
+	}
+}
+
+// Select returns the result to publish, or an error when every node failed.
+func (s *templateSelector) Select(results []*nodeResult) (*nodeResult, *nodeSelection, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.clock.Now()
+
+	var best, current *nodeResult
+	var failures []string
+	succeeded := 0
+	for _, result := range results {
+		s.last[result.node] = result
+		if result.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", result.node, result.err))
+			continue
+		}
+		succeeded++
+		if result.node == s.current {
+			current = result
+		}
+		if best == nil || s.beats(result, best, 0) {
+			best = result
+		}
+	}
+	if best == nil {
+		return nil, nil, errors.Errorf("all %d nodes failed: %s", len(results), strings.Join(failures, "; "))
+	}
+
+	chosen, reason := best, selectedBest
+	switch {
+	case current == nil && s.current != "":
+		reason = selectedFailover
+	case succeeded == 1:
+		reason = selectedOnlyNode
+	case current != nil && current != best && now.Sub(s.switchedAt) < s.minHold:
+		chosen, reason = current, selectedHold
+	case current != nil && current != best && !s.beats(best, current, s.margin):
+		chosen, reason = current, selectedWithinMargin
+	}
+
+	if chosen.node != s.current {
+		if s.current != "" {
+			s.switches++
+		}
+		s.current, s.switchedAt = chosen.node, now
+	}
+	if s.selected[chosen.node] == nil {
+		s.selected[chosen.node] = make(map[string]uint64)
+	}
+	s.selected[chosen.node][reason]++
+	return chosen, &nodeSelection{Node: chosen.node, Policy: s.policy, Reason: reason}, nil
+}
+
+func (s *templateSelector) writeMetrics(w io.Writer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, node := range s.nodes {
+		result, ok := s.last[node]
+		if !ok {
+			continue
+		}
+		up := 0
+		if result.err == nil {
+			up = 1
+		}
+		fmt.Fprintf(w, "katpool_node_up{node=%q} %d\n", node, up)
+		fmt.Fprintf(w, "katpool_node_fetch_latency_seconds{node=%q} %g\n", node, result.latency.Seconds())
+		for reason, count := range s.selected[node] {
+			fmt.Fprintf(w, "katpool_node_selected_total{node=%q,policy=%q,reason=%q} %d\n", node, s.policy, reason, count)
+		}
+	}
+	fmt.Fprintf(w, "katpool_node_switches_total %d\n", s.switches)
+}
+
+type nodeStatus struct {
+	Node      string `json:"node"`
+	Up        bool   `json:"up"`
+	LatencyMs int64  `json:"latency_ms"`
+	LastError string `json:"last_error,omitempty"`
+	Selected  bool   `json:"selected"`
+}
+
+func (s *templateSelector) statusSection() interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nodes := make([]nodeStatus, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		entry := nodeStatus{Node: node, Selected: node == s.current}
+		if result, ok := s.last[node]; ok {
+			entry.Up = result.err == nil
+			entry.LatencyMs = result.latency.Milliseconds()
+			if result.err != nil {
+				entry.LastError = result.err.Error()
+			}
+		}
+		nodes = append(nodes, entry)
+	}
+	return map[string]interface{}{
+		"policy":   s.policy,
+		"current":  s.current,
+		"switches": s.switches,
+		"nodes":    nodes,
+	}
+}
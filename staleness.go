@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+type StalenessConfig struct {
+	MaxDAASteps uint64 `json:"max_daa_steps"`
+	MaxValidMs  int64  `json:"max_valid_ms"`
+	// ExpectedDAAStepMs is the assumed time between DAA steps until the block
+	// rate has been observed, the network's target by default
+	ExpectedDAAStepMs int64 `json:"expected_daa_step_ms"`
+	// RedisKey, when set, holds the expiry of the last template for consumers
+	// that receive bare templates, and expires along with it
+	RedisKey string `json:"redis_key"`
+}
+
+func (c *StalenessConfig) validate() error {
+	if err := checkRange("staleness.max_valid_ms", c.MaxValidMs, maxConfigMs); err != nil {
+		return err
+	}
+	return checkRange("staleness.expected_daa_step_ms", c.ExpectedDAAStepMs, maxConfigMs)
+}
+
+// One DAA step per second is the target of every supported network.
+const defaultDAAStepInterval = time.Second
+
+// stalenessEstimator tells consumers when a template should be discarded: once
+// the DAA score has moved MaxDAASteps past the template's, or at the
+// wall-clock time that is expected to happen given the observed block rate.
+type stalenessEstimator struct {
+	maxSteps uint64
+	maxValid time.Duration
+
+	mutex     sync.Mutex
+	lastDAA   uint64
+	lastDAAAt time.Time
+	// stepInterval is a moving average of the time between DAA steps
+	stepInterval time.Duration
+}
+
+func newStalenessEstimator(config StalenessConfig) *stalenessEstimator {
+	e := &stalenessEstimator{
+		maxSteps:     config.MaxDAASteps,
+		maxValid:     time.Duration(config.MaxValidMs) * time.Millisecond,
+		stepInterval: time.Duration(config.ExpectedDAAStepMs) * time.Millisecond,
+	}
+	if e.stepInterval == 0 {
+		e.stepInterval = defaultDAAStepInterval
+	}
+	if e.maxSteps == 0 {
+		e.maxSteps = 5
+	}
+	if e.maxValid == 0 {
+		e.maxValid = 30 * time.Second
+	}
+	return e
+}
+
+// Observe feeds the DAA score of a template fetched at fetchedAt into the
+// block rate estimate.
+func (e *stalenessEstimator) Observe(daaScore uint64, fetchedAt time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.lastDAA != 0 && daaScore > e.lastDAA && fetchedAt.After(e.lastDAAAt) {
+		sample := fetchedAt.Sub(e.lastDAAAt) / time.Duration(daaScore-e.lastDAA)
+		e.stepInterval = (e.stepInterval*7 + sample) / 8
+	}
+	if daaScore != e.lastDAA {
+		e.lastDAA, e.lastDAAAt = daaScore, fetchedAt
+	}
+}
+
+// Expiry returns the DAA score and wall-clock time (unix ms) after which
+// template is stale.
+func (e *stalenessEstimator) Expiry(template *appmessage.GetBlockTemplateResponseMessage) (uint64, int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	header := template.Block.Header
+	valid := e.stepInterval * time.Duration(e.maxSteps)
+	if valid > e.maxValid {
+		valid = e.maxValid
+	}
+	return header.DAAScore + e.maxSteps, header.Timestamp + valid.Milliseconds()
+}
+
+func (e *stalenessEstimator) writeMetrics(w io.Writer) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	fmt.Fprintf(w, "katpool_daa_step_interval_seconds %g\n", e.stepInterval.Seconds())
+}
+
+// writeExpiry stores the expiry of the template published in envelope under
+// key, expiring the key itself at the same wall-clock time.
+func writeExpiry(ctx context.Context, rdb *redis.Client, key string, envelope *TemplateEnvelope) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key,
+			"sequence", envelope.Sequence,
+			"fingerprint", envelope.Fingerprint,
+			"expires_at_daa_score", envelope.ExpiresAtDAAScore,
+			"expires_at", envelope.ExpiresAt,
+		)
+		pipe.PExpireAt(ctx, key, time.UnixMilli(envelope.ExpiresAt))
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error updating template expiry")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// statusRegistry builds the /status document from sections registered by
+// each component.
+type statusRegistry struct {
+	mutex    sync.Mutex
+	sections map[string]func() interface{}
+}
+
+var status = &statusRegistry{sections: make(map[string]func() interface{})}
+
+func (s *statusRegistry) Register(name string, section func() interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sections[name] = section
+}
+
+func (s *statusRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	document := make(map[string]interface{}, len(s.sections))
+	for name, section := range s.sections {
+		document[name] = section()
+	}
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(document)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+// templateSummary holds the header fields and statistics most consumers
+// look at, without the transaction list.
+type templateSummary struct {
+	DAAScore      uint64 `json:"daa_score"`
+	BlueScore     uint64 `json:"blue_score"`
+	Bits          uint32 `json:"bits"`
+	Timestamp     int64  `json:"timestamp"`
+	TxCount       int    `json:"tx_count"`
+	CoinbaseValue uint64 `json:"coinbase_value"`
+	MergedFees    uint64 `json:"merged_fees"`
+}
+
+// summarizeTemplate computes the template summary. The coinbase pays the blue
+// blocks of the template's mergeset, each output one block subsidy (read from
+// the coinbase payload) plus that block's fees, so whatever exceeds the
+// subsidies is the fees of the merged blocks. The template carries no input
+// amounts, the fees of its own transactions come from the node's mempool.
+func summarizeTemplate(template *appmessage.GetBlockTemplateResponseMessage) templateSummary {
+	var summary templateSummary
+	if template.Block == nil || template.Block.Header == nil {
+		return summary
+	}
+	header := template.Block.Header
+	summary.DAAScore = header.DAAScore
+	summary.BlueScore = header.BlueScore
+	summary.Bits = header.Bits
+	summary.Timestamp = header.Timestamp
+
+	transactions := template.Block.Transactions
+	if len(transactions) == 0 {
+		return summary
+	}
+	summary.TxCount = len(transactions) - 1
+
+	coinbase := transactions[0]
+	for _, output := range coinbase.Outputs {
+		summary.CoinbaseValue += output.Amount
+	}
+	payload, err := hex.DecodeString(coinbase.Payload)
+	if err != nil || len(payload) < 16 {
+		return summary
+	}
+	// The coinbase payload starts with the blue score followed by the subsidy
+	subsidy := binary.LittleEndian.Uint64(payload[8:16])
+	subsidies := subsidy * uint64(len(coinbase.Outputs))
+	if summary.CoinbaseValue > subsidies {
+		summary.MergedFees = summary.CoinbaseValue - subsidies
+	}
+	return summary
+}
+
+// coinbaseScript returns the script public key the template's coinbase pays
+// this block's reward to, as recorded in the coinbase payload after the blue
+// score, subsidy and script version.
+func coinbaseScript(template *appmessage.GetBlockTemplateResponseMessage) ([]byte, error) {
+	if template.Block == nil || len(template.Block.Transactions) == 0 {
+		return nil, errors.New("template has no coinbase transaction")
+	}
+	payload, err := hex.DecodeString(template.Block.Transactions[0].Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid coinbase payload")
+	}
+	const scriptOffset = 8 + 8 + 2 + 1
+	if len(payload) < scriptOffset || len(payload) < scriptOffset+int(payload[scriptOffset-1]) {
+		return nil, errors.New("coinbase payload too short")
+	}
+	return payload[scriptOffset : scriptOffset+int(payload[scriptOffset-1])], nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestPollSchedulerBackoff(t *testing.T) {
+	clk := newFakeClock()
+	scheduler := newPollScheduler(time.Second, PollingConfig{Adaptive: true, MinIntervalMs: 100, MaxIntervalMs: 8000}, clk)
+
+	for failures, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		scheduler.Failure()
+		if next := scheduler.Next(); next < backoff/2 || next > backoff {
+			t.Fatalf("after %d failures: interval %v outside [%v, %v]", failures+1, next, backoff/2, backoff)
+		}
+	}
+
+	scheduler.Success(1000, clk.Now())
+	if next := scheduler.Next(); next != time.Second {
+		t.Fatalf("first success should reset to the base interval, got %v", next)
+	}
+}
+
+func TestPollSchedulerFollowsDAARate(t *testing.T) {
+	clk := newFakeClock()
+	scheduler := newPollScheduler(time.Second, PollingConfig{Adaptive: true, MinIntervalMs: 100, MaxIntervalMs: 8000}, clk)
+
+	scheduler.Success(1000, clk.Now())
+	clk.Advance(time.Second)
+	scheduler.Success(1002, clk.Now())
+	if next := scheduler.Next(); next != 250*time.Millisecond {
+		t.Fatalf("two DAA steps per second should poll every 250ms, got %v", next)
+	}
+
+	clk.Advance(time.Second)
+	scheduler.Success(1100, clk.Now())
+	if next := scheduler.Next(); next != 100*time.Millisecond {
+		t.Fatalf("interval should be clamped to the minimum, got %v", next)
+	}
+
+	clk.Advance(100 * time.Millisecond)
+	scheduler.Success(1100, clk.Now())
+	if next := scheduler.Next(); next != 125*time.Millisecond {
+		t.Fatalf("a stalled DAA score should relax the interval, got %v", next)
+	}
+
+	wait := scheduler.Wait()
+	clk.Advance(100 * time.Millisecond)
+	select {
+	case <-wait:
+		t.Fatalf("wait fired before the interval elapsed")
+	default:
+	}
+	clk.Advance(25 * time.Millisecond)
+	select {
+	case <-wait:
+	default:
+		t.Fatalf("wait did not fire once the interval elapsed")
+	}
+}
+
+type recordingNotifier struct {
+	events []*alertEvent
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, event *alertEvent) error {
+	n.events = append(n.events, event)
+	return nil
+}
+
+func TestAlertEngineDeduplicatesAndCoolsDown(t *testing.T) {
+	clk := newFakeClock()
+	health := newFetcherHealth(clk)
+	notifier := &recordingNotifier{}
+	engine := NewAlertEngine(AlertsConfig{RuleCooldowns: map[string]int64{"stale": 60}}, []alertNotifier{notifier}, clk)
+	engine.AddRule("stale", func(ctx context.Context, now time.Time) (bool, string) {
+		last := time.UnixMilli(health.Snapshot().LastSuccess)
+		return now.Sub(last) > 10*time.Second, "stale"
+	})
+
+	ctx := context.Background()
+	health.Success(true, clk.Now())
+	for i := 0; i < 30; i++ {
+		clk.Advance(time.Second)
+		engine.evaluate(ctx, clk.Now())
+	}
+	if len(notifier.events) != 1 || notifier.events[0].State != alertFiring {
+		t.Fatalf("expected a single firing alert, got %+v", notifier.events)
+	}
+
+	health.Success(true, clk.Now())
+	engine.evaluate(ctx, clk.Now())
+	if len(notifier.events) != 2 || notifier.events[1].State != alertResolved {
+		t.Fatalf("expected the alert to resolve, got %+v", notifier.events)
+	}
+
+	// Stale again within the cooldown, then past it
+	clk.Advance(20 * time.Second)
+	engine.evaluate(ctx, clk.Now())
+	if len(notifier.events) != 2 {
+		t.Fatalf("alert fired again within its cooldown")
+	}
+	clk.Advance(30 * time.Second)
+	engine.evaluate(ctx, clk.Now())
+	if len(notifier.events) != 3 || notifier.events[2].State != alertFiring {
+		t.Fatalf("expected the alert to fire after its cooldown, got %+v", notifier.events)
+	}
+}
+
+func TestDeliveryCanaryLateAndMissing(t *testing.T) {
+	clk := newFakeClock()
+	canary := NewDeliveryCanary("channel", CanaryConfig{LateThresholdMs: 1000, MissingTimeoutMs: 5000}, clk)
+
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	delivered := &TemplateEnvelope{Sequence: 1, Fingerprint: templateFingerprint(template), FetchedAt: clk.Now().UnixMilli(), Template: template}
+	lost := &TemplateEnvelope{Sequence: 2, Fingerprint: "lost", FetchedAt: clk.Now().UnixMilli()}
+	canary.Expect(delivered)
+	canary.Expect(lost)
+
+	clk.Advance(40 * time.Millisecond)
+	payload, err := json.Marshal(delivered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary.received(payload, clk.Now())
+	if canary.delivered != 1 || canary.Pending() != 1 {
+		t.Fatalf("expected one delivery and one pending, got %d and %d", canary.delivered, canary.Pending())
+	}
+
+	clk.Advance(1500 * time.Millisecond)
+	canary.sweep(clk.Now())
+	canary.sweep(clk.Now())
+	if canary.late != 1 {
+		t.Fatalf("expected one late delivery, got %d", canary.late)
+	}
+
+	clk.Advance(5 * time.Second)
+	canary.sweep(clk.Now())
+	if canary.missing != 1 || canary.Pending() != 0 {
+		t.Fatalf("expected the lost message to be missing, got %d missing and %d pending", canary.missing, canary.Pending())
+	}
+}
+
+func TestZeroSubscribersAlert(t *testing.T) {
+	clk := newFakeClock()
+	publisher := NewTemplatePublisher(nil, "templates", true, clk)
+	canary := NewDeliveryCanary("templates", CanaryConfig{}, clk)
+	publisher.SetCanary(canary)
+	var consumers int64 = 1
+	publisher.send = func(ctx context.Context, messages [][]byte) (int64, error) {
+		if canary.Subscribed() {
+			return consumers + 1, nil
+		}
+		return consumers, nil
+	}
+	zeroSubscribers := zeroSubscribersRule(publisher)
+	generator := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1})
+	ctx := context.Background()
+	publish := func() {
+		if _, err := publisher.Publish(ctx, generator.next(), clk.Now(), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Before the canary's subscription is confirmed nothing is subtracted
+	publish()
+	if firing, message := zeroSubscribers(ctx, clk.Now()); firing || publisher.Subscribers() != 1 {
+		t.Fatalf("consumer not counted before the canary subscribed: %q", message)
+	}
+
+	canary.handle(&redis.Subscription{Kind: "subscribe", Channel: "templates", Count: 1}, clk.Now())
+	publish()
+	if firing, message := zeroSubscribers(ctx, clk.Now()); firing || publisher.Subscribers() != 1 {
+		t.Fatalf("canary counted as a consumer: %q", message)
+	}
+
+	consumers = 0
+	publish()
+	if firing, message := zeroSubscribers(ctx, clk.Now()); !firing || publisher.Subscribers() != 0 {
+		t.Fatalf("expected zero_subscribers to fire with only the canary listening, got %q", message)
+	}
+}
+
+func TestStalenessFollowsBlockRate(t *testing.T) {
+	clk := newFakeClock()
+	staleness := newStalenessEstimator(StalenessConfig{MaxDAASteps: 4, MaxValidMs: 10000})
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	template.Block.Header.Timestamp = clk.Now().UnixMilli()
+
+	daa, expiresAt := staleness.Expiry(template)
+	if daa != template.Block.Header.DAAScore+4 || expiresAt != template.Block.Header.Timestamp+4000 {
+		t.Fatalf("expected expiry 4 steps and 4s out at the default rate, got %d and %d", daa, expiresAt)
+	}
+	configured := newStalenessEstimator(StalenessConfig{MaxDAASteps: 4, MaxValidMs: 10000, ExpectedDAAStepMs: 100})
+	if _, expiresAt := configured.Expiry(template); expiresAt != template.Block.Header.Timestamp+400 {
+		t.Fatalf("expected expiry 400ms out at the configured rate, got %d", expiresAt-template.Block.Header.Timestamp)
+	}
+
+	// Ten DAA steps per second pull the estimate toward 100ms per step
+	score := template.Block.Header.DAAScore
+	for i := 0; i < 50; i++ {
+		staleness.Observe(score, clk.Now())
+		clk.Advance(time.Second)
+		score += 10
+	}
+	if _, expiresAt = staleness.Expiry(template); expiresAt-template.Block.Header.Timestamp > 500 {
+		t.Fatalf("expiry did not follow the faster block rate, %dms", expiresAt-template.Block.Header.Timestamp)
+	}
+
+	// A slow network is capped at the maximum validity
+	for i := 0; i < 50; i++ {
+		staleness.Observe(score, clk.Now())
+		clk.Advance(time.Minute)
+		score++
+	}
+	if _, expiresAt = staleness.Expiry(template); expiresAt-template.Block.Header.Timestamp != 10000 {
+		t.Fatalf("expiry not capped at the maximum validity, %dms", expiresAt-template.Block.Header.Timestamp)
+	}
+}
+
+func TestTemplateSelectorHysteresis(t *testing.T) {
+	clk := newFakeClock()
+	selector := newTemplateSelector(SelectionConfig{Policy: policyLatency, SwitchMarginPercent: 20, MinHoldMs: 5000},
+		[]string{"a", "b"}, clk)
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	round := func(a, b time.Duration, bErr error) *nodeSelection {
+		_, selection, err := selector.Select([]*nodeResult{
+			{node: "a", template: template, latency: a},
+			{node: "b", template: template, latency: b, err: bErr},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return selection
+	}
+
+	if s := round(10*time.Millisecond, 20*time.Millisecond, nil); s.Node != "a" || s.Reason != selectedBest {
+		t.Fatalf("expected the faster node, got %+v", s)
+	}
+	if s := round(10*time.Millisecond, 2*time.Millisecond, nil); s.Node != "a" || s.Reason != selectedHold {
+		t.Fatalf("expected to hold the current node, got %+v", s)
+	}
+	clk.Advance(10 * time.Second)
+	if s := round(10*time.Millisecond, 9*time.Millisecond, nil); s.Node != "a" || s.Reason != selectedWithinMargin {
+		t.Fatalf("expected to stay within the margin, got %+v", s)
+	}
+	if s := round(10*time.Millisecond, 2*time.Millisecond, nil); s.Node != "b" || s.Reason != selectedBest {
+		t.Fatalf("expected to switch to the much faster node, got %+v", s)
+	}
+	if s := round(10*time.Millisecond, 0, errors.New("down")); s.Node != "a" || s.Reason != selectedFailover {
+		t.Fatalf("expected to fail over, got %+v", s)
+	}
+	if _, _, err := selector.Select([]*nodeResult{{node: "a", err: errors.New("down")}}); err == nil {
+		t.Fatalf("expected an error when every node failed")
+	}
+}
+
+func TestTemplateSelectorBlueWorkMargin(t *testing.T) {
+	selector := newTemplateSelector(SelectionConfig{SwitchMarginPercent: 5}, []string{"a", "b"}, newFakeClock())
+	withBlueWork := func(work string) *appmessage.GetBlockTemplateResponseMessage {
+		return &appmessage.GetBlockTemplateResponseMessage{
+			Block: &appmessage.RPCBlock{Header: &appmessage.RPCBlockHeader{BlueWork: work}},
+		}
+	}
+	round := func(a, b string) *nodeSelection {
+		_, selection, err := selector.Select([]*nodeResult{
+			{node: "a", template: withBlueWork(a)},
+			{node: "b", template: withBlueWork(b)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return selection
+	}
+
+	if s := round("2710", "2700"); s.Node != "a" || s.Reason != selectedBest {
+		t.Fatalf("expected the node with more blue work, got %+v", s)
+	}
+	// 0x2904 is 4% above 0x2710
+	if s := round("2710", "2904"); s.Node != "a" || s.Reason != selectedWithinMargin {
+		t.Fatalf("expected to stay within the margin, got %+v", s)
+	}
+	// 0x2af8 is 10% above 0x2710
+	if s := round("2710", "2af8"); s.Node != "b" || s.Reason != selectedBest {
+		t.Fatalf("expected to switch past the margin, got %+v", s)
+	}
+}
+
+func TestNodePoolTimeout(t *testing.T) {
+	template := newSyntheticTemplates(LoadgenConfig{Rate: 1, BlockRate: 1}).next()
+	release := make(chan struct{})
+	var calls int32
+	pool := &nodePool{clock: realClock{}, timeout: 50 * time.Millisecond, nodes: []*poolNode{
+		{address: "fast", fetch: func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+			return template, nil
+		}},
+		{address: "slow", fetch: func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return template, nil
+		}},
+	}}
+
+	results := pool.Fetch("")
+	if results[0].err != nil || results[0].template != template {
+		t.Fatalf("expected the fast node's template, got %+v", results[0])
+	}
+	if results[1].err == nil || results[1].template != nil {
+		t.Fatalf("expected the slow node to time out, got %+v", results[1])
+	}
+	// The slow node is skipped while its call is still in flight
+	if results = pool.Fetch(""); results[1].err == nil || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected the busy node to be skipped, got %+v after %d calls", results[1], atomic.LoadInt32(&calls))
+	}
+
+	close(release)
+	for atomic.LoadInt32(&pool.nodes[1].busy) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if results = pool.Fetch(""); results[1].err != nil || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected the slow node to answer once released, got %+v", results[1])
+	}
+}
+
+func TestNodePoolFeesPolicy(t *testing.T) {
+	template := loadSyntheticTemplate(t, "many-txs.json")
+	ids, err := transactionIDs(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mempool lists every transaction but the coinbase, at a fee of 10
+	// each on node a and of 11 on node b, which is only 10% more
+	mempool := func(fee uint64) func() (*appmessage.GetMempoolEntriesResponseMessage, error) {
+		entries := make([]*appmessage.MempoolEntry, 0, len(ids)-1)
+		for _, id := range ids[1:] {
+			entries = append(entries, &appmessage.MempoolEntry{Fee: fee,
+				Transaction: &appmessage.RPCTransaction{VerboseData: &appmessage.RPCTransactionVerboseData{TransactionID: id}}})
+		}
+		return func() (*appmessage.GetMempoolEntriesResponseMessage, error) {
+			return appmessage.NewGetMempoolEntriesResponseMessage(entries), nil
+		}
+	}
+	clk := newFakeClock()
+	fetch := func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+		return template, nil
+	}
+	pool := &nodePool{clock: clk, timeout: time.Second, fees: true, nodes: []*poolNode{
+		{address: "a", fetch: fetch, mempool: mempool(10)},
+		{address: "b", fetch: fetch, mempool: mempool(11)},
+	}}
+	selector := newTemplateSelector(SelectionConfig{Policy: policyFees, SwitchMarginPercent: 20}, []string{"a", "b"}, clk)
+
+	results := pool.Fetch("")
+	if results[0].fees != uint64(10*(len(ids)-1)) || results[1].fees != uint64(11*(len(ids)-1)) {
+		t.Fatalf("unexpected template fees %d and %d", results[0].fees, results[1].fees)
+	}
+	if _, s, err := selector.Select(results); err != nil || s.Node != "b" || s.Reason != selectedBest {
+		t.Fatalf("expected the node with the higher fees, got %+v, %v", s, err)
+	}
+	results[0].fees = results[1].fees + 1
+	if _, s, _ := selector.Select(results); s.Node != "b" || s.Reason != selectedWithinMargin {
+		t.Fatalf("expected to stay within the margin, got %+v", s)
+	}
+}
+
+func TestNodePoolLatencyOnClock(t *testing.T) {
+	clk := newFakeClock()
+	pool := &nodePool{clock: clk, timeout: time.Second, nodes: []*poolNode{
+		{address: "a", fetch: func(string) (*appmessage.GetBlockTemplateResponseMessage, error) {
+			clk.Advance(30 * time.Millisecond)
+			return &appmessage.GetBlockTemplateResponseMessage{}, nil
+		}},
+	}}
+	if results := pool.Fetch(""); results[0].err != nil || results[0].latency != 30*time.Millisecond {
+		t.Fatalf("expected 30ms of latency on the clock, got %+v", results[0])
+	}
+}
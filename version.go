@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=beta-v1.0.2-main -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	// CommitTime is the time of the commit as recorded by the Go toolchain,
+	// which says nothing about when the binary was built
+	CommitTime string `json:"commit_time"`
+	GoVersion  string `json:"go_version"`
+}
+
+var (
+	buildOnce   sync.Once
+	cachedBuild buildInfo
+)
+
+// currentBuild returns the linked in build information, falling back to the
+// VCS data the Go toolchain records when the ldflags were not set.
+func currentBuild() buildInfo {
+	buildOnce.Do(func() { cachedBuild = readBuild() })
+	return cachedBuild
+}
+
+func readBuild() buildInfo {
+	build := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		vcs := make(map[string]string)
+		for _, setting := range info.Settings {
+			vcs[setting.Key] = setting.Value
+		}
+		if build.Commit == "" {
+			build.Commit = vcs["vcs.revision"]
+		}
+		// Only trust the commit time when it belongs to the reported commit
+		if build.Commit != "" && build.Commit == vcs["vcs.revision"] {
+			build.CommitTime = vcs["vcs.time"]
+		}
+	}
+	for _, field := range []*string{&build.Commit, &build.BuildTime, &build.CommitTime} {
+		if *field == "" {
+			*field = "unknown"
+		}
+	}
+	return build
+}
+
+// Short identifies the build in every envelope and heartbeat. Bare templates
+// have nowhere to carry it, their consumers find the build in heartbeats,
+// the katpool_build_info metric and /status.
+func (b buildInfo) Short() string {
+	commit := b.Commit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	return b.Version + "+" + commit
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("%s (commit %s from %s, built %s, %s)", b.Version, b.Commit, b.CommitTime, b.BuildTime, b.GoVersion)
+}
+
+func (b buildInfo) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "katpool_build_info{version=%q,commit=%q,commit_time=%q,build_time=%q} 1\n",
+		b.Version, b.Commit, b.CommitTime, b.BuildTime)
+}
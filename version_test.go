@@ -0,0 +1,36 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestReadBuild(t *testing.T) {
+	defer func(v, c, b string) { version, commit, buildTime = v, c, b }(version, commit, buildTime)
+
+	// Test binaries carry no VCS stamp, so nothing fills the gaps
+	build := readBuild()
+	if build.Version != "dev" || build.Commit != "unknown" || build.BuildTime != "unknown" ||
+		build.CommitTime != "unknown" || build.GoVersion != runtime.Version() {
+		t.Fatalf("unexpected default build %+v", build)
+	}
+	if short := build.Short(); short != "dev+unknown" {
+		t.Fatalf("unexpected short build %s", short)
+	}
+
+	version, commit, buildTime = "beta-v1.0.2-main", "0123456789abcdef0123456789abcdef01234567", "2024-01-01T00:00:00Z"
+	build = readBuild()
+	if build.Version != version || build.Commit != commit || build.BuildTime != buildTime {
+		t.Fatalf("linked build information not used: %+v", build)
+	}
+	// The commit time is only known for the commit the toolchain stamped
+	if build.CommitTime != "unknown" {
+		t.Fatalf("commit time %s reported for a commit the toolchain did not record", build.CommitTime)
+	}
+	if short := build.Short(); short != "beta-v1.0.2-main+0123456789ab" {
+		t.Fatalf("unexpected short build %s", short)
+	}
+	if short := (buildInfo{Version: "dev", Commit: "abc"}).Short(); short != "dev+abc" {
+		t.Fatalf("unexpected short build %s", short)
+	}
+}